@@ -0,0 +1,283 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// TagSize is the size in bytes of the authentication tag appended by Seal.
+const TagSize = 16
+
+var errOpen = errors.New("crypto/rabbit: message authentication failed")
+
+// An AEAD provides authenticated encryption with associated data using
+// Rabbit, and implements crypto/cipher.AEAD. Each message is encrypted
+// under the key and a nonce used as the Initialization vector. The first 32
+// bytes of key stream for that nonce key an HMAC-SHA256, truncated to
+// TagSize bytes, over the additional data, the ciphertext, and their
+// lengths as 8-byte little-endian integers; the rest encrypts the message.
+// A nonce must never be reused with the same key.
+type AEAD struct {
+	c *Cipher
+}
+
+// NewAEAD creates and returns an AEAD.
+// Rabbit key, must be 16 bytes.
+func NewAEAD(key []byte) (*AEAD, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &AEAD{c}, nil
+}
+
+// NonceSize returns the size of the nonce that must be passed to Seal and Open.
+func (a *AEAD) NonceSize() int {
+	return IVSize
+}
+
+// Overhead returns the difference between the lengths of a ciphertext and
+// its plaintext.
+func (a *AEAD) Overhead() int {
+	return TagSize
+}
+
+// cipher returns a Cipher set up for nonce and the MAC key for the message.
+func (a *AEAD) cipher(nonce []byte) (*Cipher, []byte) {
+	if len(nonce) != IVSize {
+		panic("crypto/rabbit: incorrect nonce length given to AEAD")
+	}
+	c := a.c.Clone()
+	c.SetupIV(nonce)
+	return c, c.Keystream(32)
+}
+
+func tag(macKey, additionalData, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, macKey)
+	h.Write(additionalData)
+	h.Write(ciphertext)
+	return tagSum(h, uint64(len(additionalData)), uint64(len(ciphertext)))
+}
+
+// tagSum finishes a tag once h has been given the additional data and the
+// ciphertext, of adLen and ctLen bytes.
+func tagSum(h hash.Hash, adLen, ctLen uint64) []byte {
+	var n [16]byte
+	binary.LittleEndian.PutUint64(n[:], adLen)
+	binary.LittleEndian.PutUint64(n[8:], ctLen)
+	h.Write(n[:])
+	return h.Sum(nil)[:TagSize]
+}
+
+// tagEqual compares two tags in time independent of their contents.
+func tagEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// Seal encrypts and authenticates plaintext, authenticates additionalData,
+// and appends the result to dst, returning the updated slice. The nonce
+// must be NonceSize bytes long. The additional data is not encrypted or
+// included in the output; the same value must be passed to Open.
+func (a *AEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	c, macKey := a.cipher(nonce)
+	ret, out := sliceForAppend(dst, len(plaintext)+TagSize)
+	c.xorKeyStream(out[:len(plaintext)], plaintext)
+	copy(out[len(plaintext):], tag(macKey, additionalData, out[:len(plaintext)]))
+	c.Reset()
+	return ret
+}
+
+// Open authenticates and decrypts ciphertext, authenticates additionalData,
+// and appends the resulting plaintext to dst, returning the updated slice.
+// If the ciphertext or the additional data does not authenticate, Open
+// returns an error and no plaintext.
+func (a *AEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < TagSize {
+		return nil, errOpen
+	}
+	c, macKey := a.cipher(nonce)
+	defer c.Reset()
+	n := len(ciphertext) - TagSize
+	if !tagEqual(tag(macKey, additionalData, ciphertext[:n]), ciphertext[n:]) {
+		return nil, errOpen
+	}
+	ret, out := sliceForAppend(dst, n)
+	c.xorKeyStream(out, ciphertext[:n])
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// A verifyingReader decrypts a sealed stream, holding back the last
+// TagSize bytes read since they may be the tag.
+type verifyingReader struct {
+	c    *Cipher
+	r    io.Reader
+	mac  hash.Hash
+	n    uint64
+	buf  []byte
+	hold int
+	err  error
+}
+
+// NewVerifyingReader returns a Reader decrypting a stream sealed as by
+// AEAD.Seal with key, iv as the nonce and no additional data: the
+// ciphertext followed by a TagSize-byte tag. The tag is never returned as
+// plaintext, and is checked once r reports io.EOF; if it does not
+// authenticate, the final Read returns an error instead of io.EOF.
+// Plaintext is returned as it is decrypted, before the tag is checked, so
+// it must not be acted on until Read has returned io.EOF.
+func NewVerifyingReader(key, iv []byte, r io.Reader) (io.Reader, error) {
+	if k := len(iv); !ValidIVSize(k) {
+		return nil, IVSizeError(k)
+	}
+	c, err := NewCipherWithIV(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	macKey := c.Keystream(32)
+	return &verifyingReader{c: c, r: r, mac: hmac.New(sha256.New, macKey)}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cap(v.buf) < TagSize+len(p) {
+		b := make([]byte, TagSize+len(p))
+		copy(b, v.buf[:v.hold])
+		v.buf = b
+	}
+	for {
+		m, err := v.r.Read(v.buf[v.hold : v.hold+len(p)])
+		total := v.hold + m
+		n := total - TagSize
+		if n < 0 {
+			n = 0
+		}
+		v.mac.Write(v.buf[:n])
+		if err == io.EOF {
+			v.err = io.EOF
+			if total < TagSize || !tagEqual(tagSum(v.mac, 0, v.n+uint64(n)), v.buf[n:total]) {
+				v.err = errOpen
+				n = 0
+			}
+			v.c.xorKeyStream(p[:n], v.buf[:n])
+			v.c.Reset()
+			return n, v.err
+		}
+		v.c.xorKeyStream(p[:n], v.buf[:n])
+		v.n += uint64(n)
+		v.hold = copy(v.buf, v.buf[n:total])
+		if err != nil {
+			v.err = err
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// MaxFrameSize is the largest plaintext accepted by WriteFrame and ReadFrame.
+const MaxFrameSize = 1 << 24
+
+var (
+	errFrameSize      = errors.New("crypto/rabbit: frame too large")
+	errFrameMalformed = errors.New("crypto/rabbit: malformed frame")
+	errFrameTruncated = errors.New("crypto/rabbit: truncated frame")
+)
+
+// A Framer sends or receives a sequence of authenticated messages over a
+// stream, preserving message boundaries. Each frame is a 4-byte big-endian
+// length followed by the message sealed with an AEAD, using the frame's
+// sequence number as nonce. Since sequence numbers restart at zero for each
+// Framer, a key must only be used by a single writing Framer, and frames
+// must be read in the order they were written.
+type Framer struct {
+	a   *AEAD
+	seq uint64
+}
+
+// NewFramer creates and returns a Framer.
+// Rabbit key, must be 16 bytes.
+func NewFramer(key []byte) (*Framer, error) {
+	a, err := NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Framer{a: a}, nil
+}
+
+// nonce returns the nonce for the current sequence number; callers advance
+// f.seq once the frame has been sealed or opened.
+func (f *Framer) nonce() []byte {
+	return binary.LittleEndian.AppendUint64(nil, f.seq)
+}
+
+// WriteFrame seals plaintext and writes it to w as the next frame.
+func (f *Framer) WriteFrame(w io.Writer, plaintext []byte) error {
+	if len(plaintext) > MaxFrameSize {
+		return errFrameSize
+	}
+	n := len(plaintext) + TagSize
+	frame := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint32(frame, uint32(n))
+	frame = f.a.Seal(frame, f.nonce(), plaintext, nil)
+	f.seq++
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the next frame from r and returns its plaintext once the
+// tag has been verified. It returns io.EOF if r ends cleanly between frames.
+// The sequence number only advances when a frame opens, so after a frame
+// that fails to verify the Framer still expects the frame with that number.
+func (f *Framer) ReadFrame(r io.Reader) ([]byte, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errFrameTruncated
+		}
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(h[:]))
+	if n < TagSize || n > MaxFrameSize+TagSize {
+		return nil, errFrameMalformed
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errFrameTruncated
+		}
+		return nil, err
+	}
+	out, err := f.a.Open(frame[:0], f.nonce(), frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	f.seq++
+	return out, nil
+}
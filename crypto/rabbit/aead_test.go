@@ -0,0 +1,198 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+var _ cipher.AEAD = (*AEAD)(nil)
+
+func TestAEAD(t *testing.T) {
+	r := testVectors[0]
+	a, err := NewAEAD(r.key)
+	if err != nil {
+		t.Fatalf("NewAEAD: %v", err)
+	}
+	for _, n := range []int{0, 1, 15, 16, 17, 100} {
+		plaintext := make([]byte, n)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		prefix := []byte("prefix")
+		sealed := a.Seal(prefix, r.iv, plaintext, nil)
+		if !bytes.Equal(sealed[:len(prefix)], prefix) || len(sealed) != len(prefix)+n+a.Overhead() {
+			t.Fatalf("Seal(%d): bad output length %d", n, len(sealed))
+		}
+		ciphertext := sealed[len(prefix):]
+		got, err := a.Open(nil, r.iv, ciphertext, nil)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("Open(%d): got %x, %v, want %x", n, got, err, plaintext)
+		}
+		for i := range ciphertext {
+			ciphertext[i] ^= 1
+			if got, err := a.Open(nil, r.iv, ciphertext, nil); err == nil || got != nil {
+				t.Fatalf("Open(%d): accepted ciphertext modified at %d", n, i)
+			}
+			ciphertext[i] ^= 1
+		}
+		if _, err := a.Open(nil, []byte("otherIV!"), ciphertext, nil); err == nil {
+			t.Fatalf("Open(%d): accepted wrong nonce", n)
+		}
+	}
+	if _, err := a.Open(nil, r.iv, make([]byte, TagSize-1), nil); err == nil {
+		t.Errorf("Open: accepted truncated ciphertext")
+	}
+}
+
+func TestFramer(t *testing.T) {
+	key := testVectors[1].key
+	w, _ := NewFramer(key)
+	msgs := [][]byte{[]byte("hello"), nil, make([]byte, 100), []byte("hello")}
+	var stream bytes.Buffer
+	for _, m := range msgs {
+		if err := w.WriteFrame(&stream, m); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+	}
+	data := stream.Bytes()
+	r, _ := NewFramer(key)
+	for i, m := range msgs {
+		got, err := r.ReadFrame(&stream)
+		if err != nil || !bytes.Equal(got, m) {
+			t.Fatalf("ReadFrame [%d] = %q, %v, want %q", i, got, err, m)
+		}
+	}
+	if _, err := r.ReadFrame(&stream); err != io.EOF {
+		t.Fatalf("ReadFrame at end: got error %v, want io.EOF", err)
+	}
+	for _, n := range []int{1, 3, 4, 10, 4 + 5 + TagSize - 1} {
+		r, _ := NewFramer(key)
+		if _, err := r.ReadFrame(bytes.NewReader(data[:n])); err != errFrameTruncated {
+			t.Errorf("ReadFrame of %d bytes: got error %v, want %v", n, err, errFrameTruncated)
+		}
+	}
+	for _, h := range [][]byte{{0, 0, 0, 1}, {0xFF, 0xFF, 0xFF, 0xFF}} {
+		r, _ := NewFramer(key)
+		if _, err := r.ReadFrame(bytes.NewReader(h)); err != errFrameMalformed {
+			t.Errorf("ReadFrame of header %X: got error %v, want %v", h, err, errFrameMalformed)
+		}
+	}
+	bad := append([]byte(nil), data...)
+	bad[6] ^= 1
+	r, _ = NewFramer(key)
+	if got, err := r.ReadFrame(bytes.NewReader(bad)); err == nil || got != nil {
+		t.Errorf("ReadFrame accepted a modified frame")
+	}
+	// A rejected frame does not use up its sequence number.
+	forged := append(bad[:4+5+TagSize:4+5+TagSize], data...)
+	fr := bytes.NewReader(forged)
+	r, _ = NewFramer(key)
+	if _, err := r.ReadFrame(fr); err == nil {
+		t.Errorf("ReadFrame accepted a modified frame")
+	}
+	for i, m := range msgs {
+		got, err := r.ReadFrame(fr)
+		if err != nil || !bytes.Equal(got, m) {
+			t.Fatalf("ReadFrame [%d] after a modified frame = %q, %v, want %q", i, got, err, m)
+		}
+	}
+	r, _ = NewFramer(key)
+	r.ReadFrame(bytes.NewReader(data))
+	if _, err := r.ReadFrame(bytes.NewReader(data)); err == nil {
+		t.Errorf("ReadFrame accepted a replayed frame")
+	}
+}
+
+func TestAEADAdditionalData(t *testing.T) {
+	a, _ := NewAEAD(testVectors[3].key)
+	nonce := testVectors[3].iv
+	plaintext, ad := []byte("attack at dawn"), []byte("header v1")
+	sealed := a.Seal(nil, nonce, plaintext, ad)
+	if got, err := a.Open(nil, nonce, sealed, ad); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open = %q, %v, want %q", got, err, plaintext)
+	}
+	if bytes.Contains(sealed, ad) {
+		t.Errorf("Seal: additional data included in output")
+	}
+	for _, bad := range [][]byte{nil, []byte("header v2"), []byte("header v1 "), ad[:8]} {
+		if got, err := a.Open(nil, nonce, sealed, bad); err == nil || got != nil {
+			t.Errorf("Open accepted additional data %q, sealed with %q", bad, ad)
+		}
+	}
+	bad := append([]byte(nil), sealed...)
+	bad[0] ^= 1
+	if _, err := a.Open(nil, nonce, bad, ad); err == nil {
+		t.Errorf("Open accepted modified ciphertext with correct additional data")
+	}
+	// Moving bytes between the additional data and the ciphertext must not
+	// keep the tag valid.
+	empty := a.Seal(nil, nonce, nil, []byte("ab"))
+	if _, err := a.Open(nil, nonce, empty, []byte("a")); err == nil {
+		t.Errorf("Open accepted truncated additional data")
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	r := testVectors[4]
+	a, _ := NewAEAD(r.key)
+	for _, n := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := make([]byte, n)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		sealed := a.Seal(nil, r.iv, plaintext, nil)
+		for _, wrap := range []func(io.Reader) io.Reader{
+			func(r io.Reader) io.Reader { return r },
+			iotest.OneByteReader,
+			iotest.DataErrReader,
+		} {
+			vr, err := NewVerifyingReader(r.key, r.iv, wrap(bytes.NewReader(sealed)))
+			if err != nil {
+				t.Fatalf("NewVerifyingReader: %v", err)
+			}
+			got, err := io.ReadAll(vr)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("VerifyingReader(%d): got %x, %v, want %x", n, got, err, plaintext)
+			}
+		}
+		for _, i := range []int{0, n / 2, len(sealed) - 1} {
+			bad := append([]byte(nil), sealed...)
+			bad[i] ^= 1
+			vr, _ := NewVerifyingReader(r.key, r.iv, iotest.HalfReader(bytes.NewReader(bad)))
+			got, err := io.ReadAll(vr)
+			if err != errOpen {
+				t.Fatalf("VerifyingReader(%d) modified at %d: got error %v, want %v", n, i, err, errOpen)
+			}
+			if len(got) > len(sealed)-TagSize {
+				t.Fatalf("VerifyingReader(%d): returned %d bytes, more than the ciphertext", n, len(got))
+			}
+		}
+	}
+	vr, _ := NewVerifyingReader(r.key, r.iv, bytes.NewReader(make([]byte, TagSize-1)))
+	if _, err := io.ReadAll(vr); err != errOpen {
+		t.Errorf("VerifyingReader of %d bytes: got error %v, want %v", TagSize-1, err, errOpen)
+	}
+	if _, err := NewVerifyingReader(r.key, nil, bytes.NewReader(nil)); err != IVSizeError(0) {
+		t.Errorf("NewVerifyingReader with empty iv: got error %v, want IVSizeError(0)", err)
+	}
+}
+
+func TestOpenTagBytes(t *testing.T) {
+	a, _ := NewAEAD(testVectors[2].key)
+	nonce := testVectors[2].iv
+	sealed := a.Seal(nil, nonce, []byte("attack at dawn"), nil)
+	for _, i := range []int{len(sealed) - TagSize, len(sealed) - 1} {
+		bad := append([]byte(nil), sealed...)
+		bad[i] ^= 0x80
+		if got, err := a.Open(nil, nonce, bad, nil); err == nil || got != nil {
+			t.Errorf("Open accepted a tag modified at byte %d", i-(len(sealed)-TagSize))
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+// State is a copy of the internal state of a Cipher, for tests only.
+// Pending holds the buffered key stream bytes, left-aligned, with the rest
+// zero, so two States compare equal exactly when the ciphers will produce
+// the same output.
+type State struct {
+	X, C, CX, CC, IX, IC  [8]uint32
+	Carry, CCarry, ICarry uint32
+	Pending               [16]byte
+	PendingLen            int
+	Count                 uint64
+}
+
+// StateOf returns a snapshot of the internal state of c.
+func StateOf(c *Cipher) State {
+	s := State{
+		X: c.x, C: c.c, CX: c.cx, CC: c.cc, IX: c.ix, IC: c.ic,
+		Carry: c.carry, CCarry: c.ccarry, ICarry: c.icarry,
+		PendingLen: c.rn, Count: c.count,
+	}
+	copy(s.Pending[:], c.r[16-c.rn:])
+	return s
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// EncryptFile encrypts the file at srcPath with key and iv and writes the
+// result to dstPath, preceded by the 8-byte iv, so that DecryptFile or
+// NewReaderWithIVPrefix can read it back. The file is streamed in 32KB
+// chunks. The output is written to a temporary file in the same directory
+// and renamed to dstPath only on success, so a failure never leaves a
+// partial dstPath behind.
+func EncryptFile(key, iv []byte, srcPath, dstPath string) error {
+	if k := len(iv); !ValidIVSize(k) {
+		return IVSizeError(k)
+	}
+	c, err := NewCipherWithIV(key, iv)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFileAtomic(dstPath, func(f *os.File) error {
+		if _, err := f.Write(iv); err != nil {
+			return err
+		}
+		_, err := io.Copy(NewWriter(c, f), src)
+		return err
+	})
+}
+
+// DecryptFile decrypts the file at srcPath, as written by EncryptFile, with
+// key and writes the plaintext to dstPath, with the same temporary file and
+// rename as EncryptFile.
+func DecryptFile(key []byte, srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, err := NewReaderWithIVPrefix(key, src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dstPath, func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+}
+
+// writeFileAtomic calls fill with a new temporary file next to path and
+// renames it to path if fill, syncing and closing the file succeed, so path
+// never refers to a partly written file. Otherwise the temporary file is
+// removed.
+func writeFileAtomic(path string, fill func(*os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = fill(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
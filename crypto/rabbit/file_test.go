@@ -0,0 +1,65 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptFile(t *testing.T) {
+	r := testVectors[16]
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	enc := filepath.Join(dir, "enc")
+	dec := filepath.Join(dir, "dec")
+	want := make([]byte, 3*bufSize+11)
+	for i := range want {
+		want[i] = byte(i * 5)
+	}
+	if err := os.WriteFile(plain, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(r.key, r.iv, plain, enc); err != nil {
+		t.Fatalf("EncryptFile: %v", err)
+	}
+	got, _ := os.ReadFile(enc)
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	ct := append([]byte(nil), want...)
+	c.ProcessStream(ct)
+	if !bytes.Equal(got, append(append([]byte(nil), r.iv...), ct...)) {
+		t.Fatalf("EncryptFile: output is not iv followed by ciphertext")
+	}
+	if err := DecryptFile(r.key, enc, dec); err != nil {
+		t.Fatalf("DecryptFile: %v", err)
+	}
+	if got, _ := os.ReadFile(dec); !bytes.Equal(got, want) {
+		t.Fatalf("DecryptFile: round trip mismatch")
+	}
+
+	// Failures leave neither dstPath nor a temporary file.
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, r.iv[:5], 0o600)
+	bad := filepath.Join(dir, "bad")
+	if err := DecryptFile(r.key, short, bad); err != errIVPrefix {
+		t.Errorf("DecryptFile of short file: got error %v, want %v", err, errIVPrefix)
+	}
+	if err := EncryptFile(r.key, r.iv, dir, bad); err == nil {
+		t.Errorf("EncryptFile of a directory: expected error")
+	}
+	if err := EncryptFile(r.key, nil, plain, bad); err != IVSizeError(0) {
+		t.Errorf("EncryptFile with empty iv: got error %v, want IVSizeError(0)", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		switch e.Name() {
+		case "plain", "enc", "dec", "short":
+		default:
+			t.Errorf("unexpected file %q left in directory", e.Name())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+type interopVector struct {
+	line            int
+	key, iv, pt, ct []byte
+}
+
+func interopHex(s string) ([]byte, error) {
+	if s == `""` || s == "-" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
+
+// readInteropVectors parses testdata/interop.txt, whose ciphertexts come
+// from testdata/rabbit_ref.c.
+func readInteropVectors(t *testing.T) []interopVector {
+	f, err := os.Open("testdata/interop.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var vs []interopVector
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			t.Fatalf("interop.txt:%d: got %d fields, want 4", n, len(fields))
+		}
+		v := interopVector{line: n}
+		for i, p := range []*[]byte{&v.key, &v.iv, &v.pt, &v.ct} {
+			if *p, err = interopHex(fields[i]); err != nil {
+				t.Fatalf("interop.txt:%d: %v", n, err)
+			}
+		}
+		vs = append(vs, v)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func TestInterop(t *testing.T) {
+	vs := readInteropVectors(t)
+	if len(vs) == 0 {
+		t.Fatal("interop.txt: no vectors")
+	}
+	for _, v := range vs {
+		e, err := NewCipherWithIV(v.key, v.iv)
+		if err != nil {
+			t.Fatalf("interop.txt:%d: NewCipherWithIV: %v", v.line, err)
+		}
+		ct := make([]byte, len(v.pt))
+		e.XORKeyStream(ct, v.pt)
+		if !bytes.Equal(ct, v.ct) {
+			t.Errorf("interop.txt:%d: encrypt:\ngot  %x\nwant %x", v.line, ct, v.ct)
+		}
+		if v.iv != nil {
+			if ct, err := Encrypt(v.key, v.iv, v.pt); err != nil || !bytes.Equal(ct, v.ct) {
+				t.Errorf("interop.txt:%d: Encrypt: got %x, %v, want %x", v.line, ct, err, v.ct)
+			}
+		}
+
+		// Decrypt in uneven pieces to exercise the pending key stream.
+		c, _ := NewCipherWithIV(v.key, v.iv)
+		pt := append([]byte(nil), v.ct...)
+		for i, n := 0, 1; i < len(pt); i, n = i+n, n+3 {
+			if i+n > len(pt) {
+				n = len(pt) - i
+			}
+			c.ProcessStream(pt[i : i+n])
+		}
+		if !bytes.Equal(pt, v.pt) {
+			t.Errorf("interop.txt:%d: decrypt:\ngot  %x\nwant %x", v.line, pt, v.pt)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+type keystreamReader struct {
+	c *Cipher
+}
+
+// NewKeystreamReader returns a Reader that fills every buffer passed to
+// Read with key stream from c. Reads never fail or return short.
+func NewKeystreamReader(c *Cipher) io.Reader {
+	return keystreamReader{c}
+}
+
+func (r keystreamReader) Read(p []byte) (int, error) {
+	return r.c.Read(p)
+}
+
+// Read implements io.Reader by filling p with the next len(p) bytes of key
+// stream, advancing the cipher exactly as ProcessStream would. It always
+// returns len(p), nil, so it composes with io.ReadFull and io.Copy. The
+// output is only as unpredictable as the key and IV; it is not a substitute
+// for crypto/rand when generating keys.
+func (c *Cipher) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	c.xorKeyStream(p, p)
+	return len(p), nil
+}
+
+// ProcessReader reads up to len(out) bytes from r into out, XORs them with
+// the key stream in place and returns the number of bytes read. It makes a
+// single Read call, so the caller controls buffering; only the n bytes
+// actually read consume key stream, and successive calls continue the
+// stream where the previous one left off. Any error from r is returned
+// as is, after the n bytes have been processed.
+func (c *Cipher) ProcessReader(r io.Reader, out []byte) (int, error) {
+	n, err := r.Read(out)
+	c.ProcessStream(out[:n])
+	return n, err
+}
+
+const bufSize = 32 << 10
+
+// A Writer encrypts everything written to it with a Cipher and writes the
+// resulting ciphertext to an underlying writer.
+type Writer struct {
+	c       *Cipher
+	w       io.Writer
+	buf     []byte
+	pending []byte
+
+	pool *sync.Pool
+	bufp *[]byte
+	size int
+}
+
+// A WriterOption configures a Writer, or the buffer of the copy helpers
+// WriteKeystreamedCopy and ProcessStreamContext.
+type WriterOption func(*Writer)
+
+// WithBufferSize sets the size of the scratch buffer a Writer or copy
+// helper encrypts into, and so the largest write it makes to the underlying
+// writer. The default is 32KB. n is rounded up to a multiple of 16;
+// WithBufferSize panics if n is not positive. For a pooled Writer it only
+// sets the size of buffers allocated when the pool is empty.
+func WithBufferSize(n int) WriterOption {
+	if n <= 0 {
+		panic("crypto/rabbit: invalid buffer size")
+	}
+	n = (n + 15) &^ 15
+	return func(w *Writer) {
+		w.size = n
+	}
+}
+
+// NewWriter returns a Writer encrypting to w with c.
+func NewWriter(c *Cipher, w io.Writer, opts ...WriterOption) *Writer {
+	return newWriter(&Writer{c: c, w: w}, opts)
+}
+
+// bufferSize returns the buffer size set by opts.
+func bufferSize(opts []WriterOption) int {
+	return newWriter(new(Writer), opts).size
+}
+
+func newWriter(w *Writer, opts []WriterOption) *Writer {
+	w.size = bufSize
+	for _, o := range opts {
+		o(w)
+	}
+	return w
+}
+
+// NewPooledWriter returns a Writer encrypting to w with c that takes its
+// scratch buffer from pool for each Write and puts it back afterwards,
+// instead of keeping a buffer of its own. The pool must hold *[]byte
+// values, of any capacity; if it is empty or holds only empty slices, a
+// new buffer of the default or WithBufferSize size is allocated and later
+// put in the pool.
+func NewPooledWriter(c *Cipher, w io.Writer, pool *sync.Pool, opts ...WriterOption) *Writer {
+	return newWriter(&Writer{c: c, w: w, pool: pool}, opts)
+}
+
+// Write encrypts p and writes it to the underlying writer. It returns the
+// number of bytes of p consumed. Ciphertext the underlying writer did not
+// accept is kept and written first by the next call, so a short write or
+// an error never desynchronizes the key stream.
+func (w *Writer) Write(p []byte) (int, error) {
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		w.putBuf()
+		return 0, nil
+	}
+	w.getBuf()
+	n := 0
+	for n < len(p) {
+		m := len(p) - n
+		if m > len(w.buf) {
+			m = len(w.buf)
+		}
+		w.c.xorKeyStream(w.buf[:m], p[n:n+m])
+		n += m
+		w.pending = w.buf[:m]
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+	w.putBuf()
+	return n, nil
+}
+
+// WriteString is like Write, but copies s straight into the scratch buffer
+// so that io.WriteString does not convert it to a []byte first. It
+// consumes key stream exactly as Write(p) would for the same bytes.
+func (w *Writer) WriteString(s string) (int, error) {
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if len(s) == 0 {
+		w.putBuf()
+		return 0, nil
+	}
+	w.getBuf()
+	n := 0
+	for n < len(s) {
+		m := copy(w.buf, s[n:])
+		w.c.xorKeyStream(w.buf[:m], w.buf[:m])
+		n += m
+		w.pending = w.buf[:m]
+		if err := w.flush(); err != nil {
+			return n, err
+		}
+	}
+	w.putBuf()
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy to a Writer encrypts in
+// place in the Writer's own buffer instead of copying through a second
+// one. It reads from r until EOF or an error and returns the number of
+// bytes read. As with Write, all of them have consumed key stream, and
+// ciphertext the underlying writer did not accept is kept for the next call.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	w.getBuf()
+	var total int64
+	for {
+		n, rerr := r.Read(w.buf)
+		if n > 0 {
+			w.c.xorKeyStream(w.buf[:n], w.buf[:n])
+			total += int64(n)
+			w.pending = w.buf[:n]
+			if err := w.flush(); err != nil {
+				return total, err
+			}
+		}
+		if rerr != nil {
+			w.putBuf()
+			if rerr == io.EOF {
+				rerr = nil
+			}
+			return total, rerr
+		}
+	}
+}
+
+// Close writes out any ciphertext still held back by a short write and
+// then, if the underlying writer is an io.Closer, closes it. There is no
+// partial block to flush: every byte written is encrypted immediately, with
+// any unused key stream kept by the Cipher. If the held-back ciphertext
+// cannot be written, Close returns that error without closing, so Close may
+// be retried.
+func (w *Writer) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.putBuf()
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewWriterWithRandomIV returns a Writer encrypting to w with a new Cipher
+// for key and a random Initialization vector from crypto/rand. The IV is
+// written to w first, so the stream can be read back with
+// NewReaderWithIVPrefix.
+func NewWriterWithRandomIV(key []byte, w io.Writer) (io.WriteCloser, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var iv [IVSize]byte
+	if _, err = io.ReadFull(rand.Reader, iv[:]); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(iv[:]); err != nil {
+		return nil, err
+	}
+	c.SetupIV(iv[:])
+	return NewWriter(c, w), nil
+}
+
+// getBuf makes sure the Writer has a scratch buffer.
+func (w *Writer) getBuf() {
+	if w.buf != nil {
+		return
+	}
+	if w.pool == nil {
+		w.buf = make([]byte, w.size)
+		return
+	}
+	b, _ := w.pool.Get().(*[]byte)
+	if b == nil {
+		b = new([]byte)
+	}
+	if cap(*b) == 0 {
+		*b = make([]byte, w.size)
+	}
+	w.bufp, w.buf = b, (*b)[:cap(*b)]
+}
+
+// putBuf returns a pooled scratch buffer once no ciphertext in it is
+// waiting to be written.
+func (w *Writer) putBuf() {
+	if w.bufp == nil || len(w.pending) > 0 {
+		return
+	}
+	w.pool.Put(w.bufp)
+	w.bufp, w.buf, w.pending = nil, nil, nil
+}
+
+// flush writes out ciphertext left over from a previous short write.
+func (w *Writer) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	n, err := w.w.Write(w.pending)
+	w.pending = w.pending[n:]
+	if err == nil && len(w.pending) > 0 {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// A Reader decrypts data read from an underlying reader with a Cipher.
+type Reader struct {
+	c *Cipher
+	r io.Reader
+}
+
+// NewReader returns a Reader decrypting from r with c.
+func NewReader(c *Cipher, r io.Reader) *Reader {
+	return &Reader{c: c, r: r}
+}
+
+// Read reads ciphertext from the underlying reader into p and decrypts it.
+// Only the bytes actually read consume key stream, and errors, including
+// io.EOF, are returned as reported by the underlying reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.xorKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+var errIVPrefix = errors.New("crypto/rabbit: stream too short for IV prefix")
+
+// NewReaderWithIVPrefix returns a Reader for a stream that starts with its
+// 8-byte Initialization vector. It reads the IV from r, sets up a Cipher
+// with key and that IV, and decrypts the rest of r. If r ends before the
+// whole IV has been read, NewReaderWithIVPrefix returns an error.
+func NewReaderWithIVPrefix(key []byte, r io.Reader) (io.Reader, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var iv [IVSize]byte
+	if _, err = io.ReadFull(r, iv[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errIVPrefix
+		}
+		return nil, err
+	}
+	c.SetupIV(iv[:])
+	return NewReader(c, r), nil
+}
+
+// KeystreamChan starts a goroutine that sends successive 16-byte blocks of
+// key stream from c on the returned channel, generating a few blocks ahead,
+// until ctx is done; then the goroutine exits and the channel is closed.
+// The goroutine owns c until the channel is closed: c must not be used in
+// the meantime. Blocks are produced by NextBlock, so a partial block
+// buffered by ProcessStream is bypassed, and blocks generated ahead but
+// not received are lost.
+func (c *Cipher) KeystreamChan(ctx context.Context) <-chan [16]byte {
+	ch := make(chan [16]byte, 4)
+	go func() {
+		defer close(ch)
+		for {
+			b := c.NextBlock()
+			select {
+			case ch <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// WriteKeystreamedCopy copies from src to dst until EOF or an error,
+// encrypting or decrypting with c in chunks of 32KB, or of the size given
+// by WithBufferSize. It returns the number of bytes written and the first
+// error encountered, if any. On error the cipher has consumed key stream for
+// exactly the bytes read from src.
+func (c *Cipher) WriteKeystreamedCopy(dst io.Writer, src io.Reader, opts ...WriterOption) (int64, error) {
+	return c.ProcessStreamContext(context.Background(), dst, src, opts...)
+}
+
+// ProcessStreamContext is like WriteKeystreamedCopy but checks ctx between
+// chunks, returning ctx.Err() once it is done. Every chunk read before that
+// has been written, so the cipher is positioned right after the last byte
+// written and can carry on with the rest of the stream later.
+func (c *Cipher) ProcessStreamContext(ctx context.Context, dst io.Writer, src io.Reader, opts ...WriterOption) (int64, error) {
+	buf := make([]byte, bufferSize(opts))
+	var written int64
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			c.xorKeyStream(buf[:n], buf[:n])
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,638 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestKeystreamReader(t *testing.T) {
+	r := testVectors[0]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	want := c1.Keystream(r.zero)
+	got := make([]byte, r.zero)
+	kr := NewKeystreamReader(c2)
+	for k, l := 0, 1; k < len(got); l++ {
+		if k+l > len(got) {
+			l = len(got) - k
+		}
+		got[k] = 0xFF
+		n, err := kr.Read(got[k : k+l])
+		if n != l || err != nil {
+			t.Fatalf("Read(%d) = %d, %v", l, n, err)
+		}
+		k += l
+	}
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("KeystreamReader: out[%d] = %#x, want %#x", j, got[j], want[j])
+		}
+	}
+	if _, err := io.ReadFull(kr, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+}
+
+func TestCipherRead(t *testing.T) {
+	r := testVectors[8]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	want := d.Keystream(100)
+	got := make([]byte, 100)
+	for i := range got {
+		got[i] = 0xAA
+	}
+	if n, err := c.Read(got[:3]); n != 3 || err != nil {
+		t.Fatalf("Read = %d, %v, want 3, nil", n, err)
+	}
+	if _, err := io.ReadFull(c, got[3:]); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Read: out = %X, want %X", got, want)
+	}
+	if n, err := c.Read(nil); n != 0 || err != nil {
+		t.Fatalf("Read(nil) = %d, %v, want 0, nil", n, err)
+	}
+}
+
+type shortWriter struct {
+	b   []byte
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.b = append(w.b, p[:w.max]...)
+		return w.max, io.ErrShortWrite
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func TestWriter(t *testing.T) {
+	r := testVectors[1]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 1000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	want := make([]byte, len(src))
+	c1.XORKeyStream(want, src)
+	sw := &shortWriter{max: 7}
+	w := NewWriter(c2, sw)
+	for p, l := src, 1; len(p) > 0; l++ {
+		if l > len(p) {
+			l = len(p)
+		}
+		n, err := w.Write(p[:l])
+		if err != nil && err != io.ErrShortWrite {
+			t.Fatalf("Write: %v", err)
+		}
+		p = p[n:]
+	}
+	for len(sw.b) < len(want) {
+		if _, err := w.Write(nil); err != nil && err != io.ErrShortWrite {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for j := range want {
+		if sw.b[j] != want[j] {
+			t.Fatalf("Writer: out[%d] = %#x, want %#x", j, sw.b[j], want[j])
+		}
+	}
+}
+
+var _ io.StringWriter = (*Writer)(nil)
+
+func TestWriterWriteString(t *testing.T) {
+	r := testVectors[1]
+	src := strings.Repeat("log line 0123456789\n", 50)
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	want := []byte(src)
+	c1.ProcessStream(want)
+
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	var sink bytes.Buffer
+	w := NewWriter(c2, &sink, WithBufferSize(48))
+	for s, l := src, 1; len(s) > 0; l += 5 {
+		if l > len(s) {
+			l = len(s)
+		}
+		if _, err := io.WriteString(w, s[:l]); err != nil {
+			t.Fatalf("WriteString: %v", err)
+		}
+		// Interleave Write to check both share one key stream position.
+		s = s[l:]
+		if len(s) > 3 {
+			if _, err := w.Write([]byte(s[:3])); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			s = s[3:]
+		}
+	}
+	if !bytes.Equal(sink.Bytes(), want) {
+		t.Fatalf("WriteString: output differs from ProcessStream")
+	}
+
+	sw := &shortWriter{max: 7}
+	c3, _ := NewCipherWithIV(r.key, r.iv)
+	w = NewWriter(c3, sw)
+	n, err := w.WriteString(src[:100])
+	if n != 100 || err != io.ErrShortWrite {
+		t.Fatalf("WriteString: got %d, %v, want 100, %v", n, err, io.ErrShortWrite)
+	}
+	for len(sw.b) < 100 {
+		if _, err := w.WriteString(""); err != nil && err != io.ErrShortWrite {
+			t.Fatalf("WriteString: %v", err)
+		}
+	}
+	if !bytes.Equal(sw.b, want[:100]) {
+		t.Fatalf("WriteString: short writes desynchronized the output")
+	}
+
+	w = NewWriter(c3, io.Discard)
+	w.WriteString("warm up")
+	if n := testing.AllocsPerRun(100, func() { io.WriteString(w, src) }); n != 0 {
+		t.Errorf("WriteString: %v allocations, want 0", n)
+	}
+}
+
+func TestReader(t *testing.T) {
+	r := testVectors[2]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, 1000)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	var sink bytes.Buffer
+	w := NewWriter(c1, &sink)
+	if _, err := w.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := io.ReadAll(NewReader(c2, iotest.OneByteReader(&sink)))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Reader: round trip mismatch")
+	}
+}
+
+func TestProcessReader(t *testing.T) {
+	r := testVectors[2]
+	want := make([]byte, 1000)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	ct := append([]byte(nil), want...)
+	c1.ProcessStream(ct)
+
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := iotest.HalfReader(bytes.NewReader(ct))
+	var got []byte
+	out := make([]byte, 37)
+	for {
+		n, err := c2.ProcessReader(src, out)
+		got = append(got, out[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ProcessReader: %v", err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ProcessReader: round trip mismatch")
+	}
+	if got := c2.BytesProcessed(); got != uint64(len(want)) {
+		t.Fatalf("ProcessReader: BytesProcessed got %d, want %d", got, len(want))
+	}
+
+	c3, _ := NewCipherWithIV(r.key, r.iv)
+	n, err := c3.ProcessReader(iotest.ErrReader(io.ErrUnexpectedEOF), out)
+	if n != 0 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("ProcessReader: got %d, %v, want 0, %v", n, err, io.ErrUnexpectedEOF)
+	}
+	if got := c3.BytesProcessed(); got != 0 {
+		t.Fatalf("ProcessReader: failed read consumed %d bytes of key stream", got)
+	}
+}
+
+func TestNewReaderWithIVPrefix(t *testing.T) {
+	r := testVectors[4]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := []byte("the rest of the stream")
+	msg := append([]byte(nil), want...)
+	c.ProcessStream(msg)
+	stream := append(append([]byte(nil), r.iv...), msg...)
+	dr, err := NewReaderWithIVPrefix(r.key, iotest.OneByteReader(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatalf("NewReaderWithIVPrefix: %v", err)
+	}
+	got, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("NewReaderWithIVPrefix: out = %q, want %q", got, want)
+	}
+	for _, n := range []int{0, 1, 7} {
+		if _, err := NewReaderWithIVPrefix(r.key, bytes.NewReader(stream[:n])); err != errIVPrefix {
+			t.Errorf("NewReaderWithIVPrefix with %d byte stream: got error %v, want %v", n, err, errIVPrefix)
+		}
+	}
+	if _, err := NewReaderWithIVPrefix(r.key, iotest.ErrReader(io.ErrClosedPipe)); err != io.ErrClosedPipe {
+		t.Errorf("NewReaderWithIVPrefix: got error %v, want %v", err, io.ErrClosedPipe)
+	}
+	if _, err := NewReaderWithIVPrefix(r.key[:5], bytes.NewReader(stream)); err != KeySizeError(5) {
+		t.Errorf("NewReaderWithIVPrefix: got error %v, want KeySizeError(5)", err)
+	}
+}
+
+func TestNewWriterWithRandomIV(t *testing.T) {
+	key := testVectors[5].key
+	want := []byte("a self-contained encrypted stream")
+	var streams [2]bytes.Buffer
+	for i := range streams {
+		w, err := NewWriterWithRandomIV(key, &streams[i])
+		if err != nil {
+			t.Fatalf("NewWriterWithRandomIV: %v", err)
+		}
+		for _, p := range [][]byte{want[:5], want[5:]} {
+			if _, err := w.Write(p); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if n := streams[i].Len(); n != IVSize+len(want) {
+			t.Fatalf("NewWriterWithRandomIV: wrote %d bytes, want %d", n, IVSize+len(want))
+		}
+	}
+	if bytes.Equal(streams[0].Bytes()[:IVSize], streams[1].Bytes()[:IVSize]) {
+		t.Errorf("NewWriterWithRandomIV: two streams share IV %X", streams[0].Bytes()[:IVSize])
+	}
+	for i := range streams {
+		r, err := NewReaderWithIVPrefix(key, &streams[i])
+		if err != nil {
+			t.Fatalf("NewReaderWithIVPrefix: %v", err)
+		}
+		if got, _ := io.ReadAll(r); !bytes.Equal(got, want) {
+			t.Fatalf("NewWriterWithRandomIV: round trip out = %q, want %q", got, want)
+		}
+	}
+	if _, err := NewWriterWithRandomIV(key, &shortWriter{max: 3}); err != io.ErrShortWrite {
+		t.Errorf("NewWriterWithRandomIV: got error %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// onlyReader and onlyWriter hide any io.WriterTo or io.ReaderFrom methods,
+// forcing io.Copy to use its generic loop.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func TestWriterReadFrom(t *testing.T) {
+	r := testVectors[6]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 2*bufSize+77)
+	for i := range src {
+		src[i] = byte(i * 3)
+	}
+	var sink bytes.Buffer
+	w := NewWriter(c1, &sink)
+	w.Write(src[:5])
+	n, err := io.Copy(w, onlyReader{iotest.HalfReader(bytes.NewReader(src[5:]))})
+	if err != nil || n != int64(len(src)-5) {
+		t.Fatalf("io.Copy = %d, %v, want %d, nil", n, err, len(src)-5)
+	}
+	w.Write(src[:9])
+	want := append(append([]byte(nil), src...), src[:9]...)
+	c2.ProcessStream(want)
+	if !bytes.Equal(sink.Bytes(), want) {
+		t.Fatalf("ReadFrom: ciphertext differs from ProcessStream")
+	}
+	if _, err := w.ReadFrom(iotest.ErrReader(io.ErrClosedPipe)); err != io.ErrClosedPipe {
+		t.Errorf("ReadFrom: got error %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func benchmarkWriterCopy(b *testing.B, wrap func(*Writer) io.Writer) {
+	c, _ := NewCipher(make([]byte, 16))
+	src := make([]byte, 1<<20)
+	w := wrap(NewWriter(c, io.Discard))
+	b.SetBytes(int64(len(src)))
+	for i := 0; i < b.N; i++ {
+		io.Copy(w, onlyReader{bytes.NewReader(src)})
+	}
+}
+
+func BenchmarkWriterReadFrom(b *testing.B) {
+	benchmarkWriterCopy(b, func(w *Writer) io.Writer { return w })
+}
+
+func BenchmarkWriterCopyLoop(b *testing.B) {
+	benchmarkWriterCopy(b, func(w *Writer) io.Writer { return onlyWriter{w} })
+}
+
+// closeWriter accepts at most max bytes per Write until it is closed.
+type closeWriter struct {
+	shortWriter
+	closed bool
+}
+
+func (w *closeWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return w.shortWriter.Write(p)
+}
+
+func (w *closeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestWriterClose(t *testing.T) {
+	r := testVectors[7]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := []byte("not a multiple of sixteen bytes, 45 in total")
+	sink := &closeWriter{shortWriter: shortWriter{max: 10}}
+	w := NewWriter(c1, sink)
+	if _, err := w.Write(src); err != io.ErrShortWrite {
+		t.Fatalf("Write: got error %v, want %v", err, io.ErrShortWrite)
+	}
+	for len(sink.b) < len(src) {
+		if err := w.Close(); err == nil {
+			break
+		}
+		if sink.closed {
+			t.Fatalf("Close: underlying writer closed with ciphertext pending")
+		}
+	}
+	if !sink.closed {
+		t.Fatalf("Close: underlying writer not closed")
+	}
+	want := append([]byte(nil), src...)
+	c2.ProcessStream(want)
+	if !bytes.Equal(sink.b, want) {
+		t.Fatalf("Close: sink got %X, want %X", sink.b, want)
+	}
+	if err := NewWriter(c1, io.Discard).Close(); err != nil {
+		t.Errorf("Close with plain io.Writer: %v", err)
+	}
+}
+
+func TestKeystreamChan(t *testing.T) {
+	r := testVectors[9]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := c.KeystreamChan(ctx)
+	for i := 0; i < 20; i++ {
+		got := <-ch
+		if want := d.NextBlock(); got != want {
+			t.Fatalf("KeystreamChan block %d = %X, want %X", i, got, want)
+		}
+	}
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("KeystreamChan: channel not closed after cancel")
+		}
+	}
+}
+
+// sizeWriter records the length of every Write.
+type sizeWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestWithBufferSize(t *testing.T) {
+	r := testVectors[10]
+	src := make([]byte, 100)
+	for _, tc := range []struct {
+		opts  []WriterOption
+		sizes []int
+	}{
+		{nil, []int{100}},
+		{[]WriterOption{WithBufferSize(20)}, []int{32, 32, 32, 4}},
+		{[]WriterOption{WithBufferSize(20), WithBufferSize(48)}, []int{48, 48, 4}},
+		{[]WriterOption{WithBufferSize(1 << 20)}, []int{100}},
+	} {
+		c1, _ := NewCipherWithIV(r.key, r.iv)
+		c2, _ := NewCipherWithIV(r.key, r.iv)
+		var sink sizeWriter
+		NewWriter(c1, &sink, tc.opts...).Write(src)
+		if fmt.Sprint(sink.sizes) != fmt.Sprint(tc.sizes) {
+			t.Errorf("Write with %d options: underlying writes %v, want %v", len(tc.opts), sink.sizes, tc.sizes)
+		}
+		want := make([]byte, len(src))
+		c2.ProcessStream(want)
+		if !bytes.Equal(sink.Bytes(), want) {
+			t.Errorf("Write with %d options: ciphertext mismatch", len(tc.opts))
+		}
+	}
+	var pool sync.Pool
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	NewPooledWriter(c, io.Discard, &pool, WithBufferSize(64)).Write(src)
+	if b := pool.Get().(*[]byte); cap(*b) != 64 {
+		t.Errorf("NewPooledWriter with WithBufferSize(64): pooled buffer of %d bytes", cap(*b))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("WithBufferSize(0) did not panic")
+		}
+	}()
+	WithBufferSize(0)
+}
+
+func TestWriteKeystreamedCopy(t *testing.T) {
+	r := testVectors[3]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 3*bufSize+5)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	want := make([]byte, len(src))
+	c1.XORKeyStream(want, src)
+	var dst bytes.Buffer
+	n, err := c2.WriteKeystreamedCopy(&dst, iotest.HalfReader(bytes.NewReader(src)))
+	if n != int64(len(src)) || err != nil {
+		t.Fatalf("WriteKeystreamedCopy = %d, %v, want %d, nil", n, err, len(src))
+	}
+	if !bytes.Equal(dst.Bytes(), want) {
+		t.Fatalf("WriteKeystreamedCopy: output mismatch")
+	}
+	_, err = c2.WriteKeystreamedCopy(&dst, iotest.TimeoutReader(bytes.NewReader(src)))
+	if err != iotest.ErrTimeout {
+		t.Errorf("WriteKeystreamedCopy: got error %v, want %v", err, iotest.ErrTimeout)
+	}
+	if _, err = c2.WriteKeystreamedCopy(&shortWriter{max: 3}, bytes.NewReader(src)); err != io.ErrShortWrite {
+		t.Errorf("WriteKeystreamedCopy: got error %v, want %v", err, io.ErrShortWrite)
+	}
+
+	c3, _ := NewCipherWithIV(r.key, r.iv)
+	var sw sizeWriter
+	n, err = c3.WriteKeystreamedCopy(&sw, bytes.NewReader(src), WithBufferSize(100))
+	if n != int64(len(src)) || err != nil {
+		t.Fatalf("WriteKeystreamedCopy(WithBufferSize(100)) = %d, %v, want %d, nil", n, err, len(src))
+	}
+	if !bytes.Equal(sw.Bytes(), want) {
+		t.Fatalf("WriteKeystreamedCopy(WithBufferSize(100)): output mismatch")
+	}
+	for i, m := range sw.sizes {
+		if m > 112 {
+			t.Fatalf("WriteKeystreamedCopy(WithBufferSize(100)): write %d of %d bytes, want at most 112", i, m)
+		}
+	}
+}
+
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if r.n--; r.n == 0 {
+		r.cancel()
+	}
+	return r.r.Read(p)
+}
+
+func TestProcessStreamContext(t *testing.T) {
+	r := testVectors[4]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 5*bufSize)
+	want := make([]byte, len(src))
+	c1.XORKeyStream(want, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	var dst bytes.Buffer
+	n, err := c2.ProcessStreamContext(ctx, &dst, &cancelReader{bytes.NewReader(src), 2, cancel})
+	if err != context.Canceled || n != 2*bufSize {
+		t.Fatalf("ProcessStreamContext = %d, %v, want %d, %v", n, err, 2*bufSize, context.Canceled)
+	}
+	n, err = c2.ProcessStreamContext(context.Background(), &dst, bytes.NewReader(src[n:]))
+	if err != nil || n != 3*bufSize {
+		t.Fatalf("ProcessStreamContext = %d, %v, want %d, nil", n, err, 3*bufSize)
+	}
+	if !bytes.Equal(dst.Bytes(), want) {
+		t.Fatalf("ProcessStreamContext: resumed output mismatch")
+	}
+}
+
+func TestPooledWriter(t *testing.T) {
+	r := testVectors[5]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 2000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	want := make([]byte, len(src))
+	c1.XORKeyStream(want, src)
+	caps := []int{0, 1, 7, 16, 100}
+	pool := &sync.Pool{New: func() interface{} {
+		b := make([]byte, 0, caps[0])
+		caps = append(caps[1:], caps[0])
+		return &b
+	}}
+	sw := &shortWriter{max: 50}
+	w := NewPooledWriter(c2, sw, pool)
+	for p, l := src, 1; len(p) > 0; l++ {
+		if l > len(p) {
+			l = len(p)
+		}
+		n, err := w.Write(p[:l])
+		if err != nil && err != io.ErrShortWrite {
+			t.Fatalf("Write: %v", err)
+		}
+		p = p[n:]
+		if l%5 == 0 {
+			pool.Put(&[]byte{})
+		}
+	}
+	for len(sw.b) < len(want) {
+		w.Write(nil)
+	}
+	if !bytes.Equal(sw.b, want) {
+		t.Fatalf("PooledWriter: output mismatch")
+	}
+
+	var pool2 sync.Pool
+	w = NewPooledWriter(c2, io.Discard, &pool2)
+	w.Write(src[:10])
+	if n := testing.AllocsPerRun(100, func() { w.Write(src[:10]) }); n != 0 {
+		t.Errorf("PooledWriter: %v allocations per small write, want 0", n)
+	}
+}
+
+// TestPooledWriterLarge covers writes spanning several pooled buffers, which
+// must not hand the buffer back to the pool between chunks.
+func TestPooledWriterLarge(t *testing.T) {
+	r := testVectors[5]
+	src := make([]byte, 2*bufSize+100)
+	for i := range src {
+		src[i] = byte(i * 3)
+	}
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, 3*len(src))
+	for i := 0; i < 3; i++ {
+		c1.XORKeyStream(want[i*len(src):], src)
+	}
+
+	done := make(chan []byte)
+	go func() {
+		var pool sync.Pool
+		pool.Put(&[]byte{})
+		small := make([]byte, 48)
+		pool.Put(&small)
+		c2, _ := NewCipherWithIV(r.key, r.iv)
+		var sink bytes.Buffer
+		w := NewPooledWriter(c2, &sink, &pool)
+		w.Write(src)
+		w.WriteString(string(src))
+		w.ReadFrom(bytes.NewReader(src))
+		done <- sink.Bytes()
+	}()
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("PooledWriter: output mismatch for writes larger than the buffer")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("PooledWriter: write larger than the buffer did not return")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package rabbit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	r := testVectors[19]
+	const size = 3*4096 + 37
+	f, err := os.Create(filepath.Join(t.TempDir(), "mmap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	m, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Skipf("mmap: %v", err)
+	}
+	src := make([]byte, 5000)
+	for i := range src {
+		src[i] = byte(i * 13)
+	}
+
+	// Misaligned offsets into the mapping, for each way of writing to it.
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStreamTo(m[5:5+len(src)], src)
+	copy(m[6001:], src[:3001])
+	c.ProcessStream(m[6001 : 6001+3001])
+	c.GenerateKeystream(m[9003 : 9003+160])
+	if err = syscall.Munmap(m); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, size)
+	d.ProcessStreamTo(want[5:], src)
+	copy(want[6001:], src[:3001])
+	d.ProcessStream(want[6001 : 6001+3001])
+	d.GenerateKeystream(want[9003 : 9003+160])
+	if !bytes.Equal(got, want) {
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("mmap: file byte %d = %#x, want %#x", i, got[i], want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"math"
+	"math/big"
+	"sync"
+)
+
+// The counter system adds the constant a, with the carry bit, to the
+// 256-bit counter each round. Taking w = counter + carry modulo
+// m = 2^256 - 1, that is exactly w += a mod m, since 2^256 = 1 mod m.
+// a and m are coprime, so w runs through all of its m values before
+// repeating.
+type counterConsts struct {
+	a, m, aInv *big.Int
+}
+
+// counterConstants computes a, m and the inverse of a modulo m on first
+// use, so that importers not calling BlocksUntilWrap never pay for it.
+var counterConstants = sync.OnceValue(func() counterConsts {
+	m := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	a := counterWord([8]uint32{
+		0x4D34D34D, 0xD34D34D3, 0x34D34D34, 0x4D34D34D,
+		0xD34D34D3, 0x34D34D34, 0x4D34D34D, 0xD34D34D3,
+	}, 0, m)
+	return counterConsts{a: a, m: m, aInv: new(big.Int).ModInverse(a, m)}
+})
+
+// counterInt returns w for counter words c and carry bit carry.
+func counterInt(c [8]uint32, carry uint32) *big.Int {
+	return counterWord(c, carry, counterConstants().m)
+}
+
+func counterWord(c [8]uint32, carry uint32, m *big.Int) *big.Int {
+	w := new(big.Int)
+	for i := 7; i >= 0; i-- {
+		w.Lsh(w, 32)
+		w.Or(w, big.NewInt(int64(c[i])))
+	}
+	w.Add(w, big.NewInt(int64(carry)))
+	return w.Mod(w, m)
+}
+
+// blocksSinceIV returns the number of rounds, modulo the counter period,
+// that the counter has advanced since the start of the key stream.
+func (c *Cipher) blocksSinceIV() *big.Int {
+	cc := counterConstants()
+	k := new(big.Int).Sub(counterInt(c.c, c.carry), counterInt(c.ic, c.icarry))
+	k.Mul(k, cc.aInv)
+	return k.Mod(k, cc.m)
+}
+
+// BlocksUntilWrap returns how many more blocks of key stream can be
+// generated before the counter system returns to its value at the start of
+// the key stream, set up by the last SetupIV, SaveIVState or ResetCipher.
+// The period of the counter is 2^256 - 1 blocks, so for any practical
+// stream the result exceeds the range of uint64 and BlocksUntilWrap
+// returns math.MaxUint64; the exact count matters only to show that the
+// counter imposes no limit. See MaxStreamLength for the limit that does.
+func (c *Cipher) BlocksUntilWrap() uint64 {
+	left := new(big.Int).Sub(counterConstants().m, c.blocksSinceIV())
+	if !left.IsUint64() {
+		return math.MaxUint64
+	}
+	return left.Uint64()
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestBlocksUntilWrap(t *testing.T) {
+	cc := counterConstants()
+	if new(big.Int).GCD(nil, nil, cc.a, cc.m).Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("counter constant and period are not coprime")
+	}
+	if p := new(big.Int).Mul(cc.a, cc.aInv); p.Mod(p, cc.m).Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("counter constant inverse is wrong")
+	}
+	r := testVectors[20]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 160))
+	if k := c.blocksSinceIV(); k.Cmp(big.NewInt(10)) != 0 {
+		t.Fatalf("blocksSinceIV after 10 blocks = %v, want 10", k)
+	}
+	if n := c.BlocksUntilWrap(); n != math.MaxUint64 {
+		t.Fatalf("BlocksUntilWrap = %d, want math.MaxUint64", n)
+	}
+
+	// Put the counter 5 rounds before its starting value, with w = start - 5a.
+	w := new(big.Int).Sub(counterInt(c.ic, c.icarry), new(big.Int).Mul(big.NewInt(5), cc.a))
+	w.Mod(w, cc.m)
+	var ctr [8]uint32
+	for i := range ctr {
+		ctr[i] = uint32(new(big.Int).Rsh(w, uint(32*i)).Uint64())
+	}
+	c.SetCounter(ctr, false)
+	for want := uint64(5); want > 0; want-- {
+		if n := c.BlocksUntilWrap(); n != want {
+			t.Fatalf("BlocksUntilWrap = %d, want %d", n, want)
+		}
+		c.rabbitNext()
+	}
+	if counterInt(c.c, c.carry).Cmp(counterInt(c.ic, c.icarry)) != 0 {
+		t.Fatalf("counter after wrapping = %#x, %d, want %#x, %d", c.c, c.carry, c.ic, c.icarry)
+	}
+	if n := c.BlocksUntilWrap(); n != math.MaxUint64 {
+		t.Fatalf("BlocksUntilWrap after wrapping = %d, want math.MaxUint64", n)
+	}
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// This package implements the Rabbit encryption algorithm as defined in eSTREAM portfolio.
+// Package rabbit implements the Rabbit encryption algorithm as defined in eSTREAM portfolio.
 package rabbit
 
 // This Go implementation is derived in part from the reference
@@ -30,64 +30,175 @@ package rabbit
 //
 //	Cryptico, CryptiCore, the Cryptico logo and "Re-thinking encryption" are
 //	either trademarks or registered trademarks of Cryptico ApS.
+//
+// Unlike the reference code, this implementation converts between bytes and
+// words with encoding/binary.LittleEndian only, so its output does not depend
+// on the byte order of the host.
 
 import (
-	"os"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"maps"
+	"math/bits"
 	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// KeySize is the size of a Rabbit key in bytes.
+	KeySize = 16
+	// IVSize is the size of a Rabbit Initialization vector in bytes.
+	IVSize = 8
 )
 
 // A Cipher is an instance of Rabbit encryption using a particular key.
+// A Cipher must not be copied after first use, as both copies would go on
+// to produce the same key stream; use Clone to fork one deliberately.
+// A Cipher is not safe for concurrent use. It may panic if it detects
+// concurrent use in ProcessStream or the other methods that produce, skip
+// or seek key stream, but detection is not guaranteed.
+// The key and iv slices given to NewCipher, SetKey, SetupIV and the other
+// constructors are only read during the call and never retained; the caller
+// may overwrite or reuse them as soon as the call returns.
 type Cipher struct {
-	x, c, cx, cc [8]uint32
-	carry, ccarry bool
-	r []byte
+	noCopy noCopy
+
+	x, c, cx, cc, ix, ic [8]uint32
+	carry, ccarry, icarry uint32
+	r [16]byte
+	rn int
+
+	// count is the number of key stream bytes used since saveIV.
+	count uint64
+
+	// keyed is set by SetKey, and cleared by Reset.
+	keyed bool
+
+	// rounds is the number of key setup rounds Ratchet uses, set by
+	// NewCipherRounds; zero means the standard 4.
+	rounds int
+
+	// ivs, if not nil, holds the IVs used under the current key; see
+	// NewCipherTrackIVs.
+	ivs map[[IVSize]byte]struct{}
+
+	// busy is set while the key stream is in use, to detect some concurrent
+	// use.
+	busy atomic.Uint32
 }
 
+var (
+	// ErrKeySize matches, via errors.Is, any KeySizeError.
+	ErrKeySize = errors.New("crypto/rabbit: invalid key size")
+	// ErrIVSize matches, via errors.Is, any IVSizeError.
+	ErrIVSize = errors.New("crypto/rabbit: invalid iv size")
+	// ErrNoKey is returned by SetupIV on a Cipher that has no key: a zero
+	// Cipher before SetKey, or one after Reset.
+	ErrNoKey = errors.New("crypto/rabbit: cipher has no key")
+	// ErrZeroKey is returned by NewCipherStrict for an all-zero key.
+	ErrZeroKey = errors.New("crypto/rabbit: all-zero key")
+	// ErrZeroIV is returned by NewCipherStrict for an all-zero iv.
+	ErrZeroIV = errors.New("crypto/rabbit: all-zero iv")
+	// ErrIVReuse is returned by SetupIV on a Cipher from NewCipherTrackIVs
+	// for an iv already used under the current key.
+	ErrIVReuse = errors.New("crypto/rabbit: iv reused under the same key")
+	// ErrStreamLimit is returned by ProcessStreamChecked when a key stream
+	// would pass MaxStreamLength bytes.
+	ErrStreamLimit = errors.New("crypto/rabbit: key stream length limit reached")
+)
+
+// MaxStreamLength is the largest number of bytes that may be processed
+// under one key and IV while BytesProcessed stays exact. The counter
+// itself does not wrap for about 2^256 rounds, and this is well within the
+// 2^64 blocks the Rabbit designers allow per key, so the limit comes from
+// the 64-bit byte count. ProcessStreamChecked enforces it.
+const MaxStreamLength = 1<<64 - 1
+
+// A KeySizeError is returned by NewCipher for a key of invalid length.
 type KeySizeError int
 
-func (k KeySizeError) String() string {
+func (k KeySizeError) Error() string {
 	return "crypto/rabbit: invalid key size " + strconv.Itoa(int(k))
 }
 
+// Is reports whether target is ErrKeySize.
+func (k KeySizeError) Is(target error) bool {
+	return target == ErrKeySize
+}
+
+// An IVSizeError is returned by SetupIV for an initialization vector of
+// invalid length.
 type IVSizeError int
 
-func (k IVSizeError) String() string {
+func (k IVSizeError) Error() string {
 	return "crypto/rabbit: invalid iv size " + strconv.Itoa(int(k))
 }
 
+// Is reports whether target is ErrIVSize.
+func (k IVSizeError) Is(target error) bool {
+	return target == ErrIVSize
+}
+
+// noCopy makes go vet's copylocks check report copies of a Cipher.
+type noCopy struct{}
+
+func (*noCopy) Lock()   {}
+func (*noCopy) Unlock() {}
+
+// ValidKeySize reports whether n is a valid key size.
+func ValidKeySize(n int) bool {
+	return n == KeySize
+}
+
+// ValidIVSize reports whether n is a valid Initialization vector size.
+func ValidIVSize(n int) bool {
+	return n == IVSize
+}
+
 func rotl(v, n uint32) uint32 {
 	return v<<n | v>>(32-n)
 }
 
-func rabbitCalcG(x uint32) uint32 {
-	var a, b uint32
-	a = x&0xFFFF;
-	b = x>>16;
-	return ((((a*a)>>17 + a*b)>>15) + b*b)^(x*x)
+// rotl16 swaps the 16-bit halves of v, the fixed rotation used by the key
+// schedule.
+func rotl16(v uint32) uint32 {
+	return v<<16 | v>>16
 }
 
-func booltoi(b bool) uint32 {
-	if b {
-		return 1
-	}
-	return 0
+// rabbitCalcG is the g-function: the 64-bit square of x with its high and
+// low 32-bit halves XORed together.
+func rabbitCalcG(x uint32) uint32 {
+	s := uint64(x) * uint64(x)
+	return uint32(s) ^ uint32(s>>32)
 }
 
+// rabbitNext advances the counter and the state by one round. Carries
+// are propagated with bits.Add32, whose execution time does not depend
+// on its inputs, so there is no branch on any secret value.
+//
+// The counter is a 256-bit value plus the carry bit, and wrapping it is
+// part of the design: the carry out of c[7] feeds the next round, giving a
+// counter period of about 2^256 rounds, far beyond any stream length. No
+// other state grows with the stream except the byte count, see
+// MaxStreamLength.
+//
+// The round is fully unrolled and keeps the whole state in registers.
+// Interleaving the counter and g-function steps to shorten live ranges
+// made no repeatable difference in BenchmarkRabbitNext.
 func (c *Cipher) rabbitNext() {
-	var c0, c1, c2, c3, c4, c5, c6, c7 uint32
-
-	c0, c1, c2, c3 = c.c[0], c.c[1], c.c[2], c.c[3]
-	c4, c5, c6, c7 = c.c[4], c.c[5], c.c[6], c.c[7]
+	var c0, c1, c2, c3, c4, c5, c6, c7, k uint32
 
-	c0 = c0 + 0x4D34D34D + booltoi(c.carry)
-	c1 = c1 + 0xD34D34D3 + booltoi(c0 < c.c[0])
-	c2 = c2 + 0x34D34D34 + booltoi(c1 < c.c[1])
-	c3 = c3 + 0x4D34D34D + booltoi(c2 < c.c[2])
-	c4 = c4 + 0xD34D34D3 + booltoi(c3 < c.c[3])
-	c5 = c5 + 0x34D34D34 + booltoi(c4 < c.c[4])
-	c6 = c6 + 0x4D34D34D + booltoi(c5 < c.c[5])
-	c7 = c7 + 0xD34D34D3 + booltoi(c6 < c.c[6])
-	c.carry = (c7 < c.c[7])
+	c0, k = bits.Add32(c.c[0], 0x4D34D34D, c.carry)
+	c1, k = bits.Add32(c.c[1], 0xD34D34D3, k)
+	c2, k = bits.Add32(c.c[2], 0x34D34D34, k)
+	c3, k = bits.Add32(c.c[3], 0x4D34D34D, k)
+	c4, k = bits.Add32(c.c[4], 0xD34D34D3, k)
+	c5, k = bits.Add32(c.c[5], 0x34D34D34, k)
+	c6, k = bits.Add32(c.c[6], 0x4D34D34D, k)
+	c7, c.carry = bits.Add32(c.c[7], 0xD34D34D3, k)
 
 	g0 := rabbitCalcG(c.x[0] + c0)
 	g1 := rabbitCalcG(c.x[1] + c1)
@@ -113,18 +224,103 @@ func (c *Cipher) rabbitNext() {
 
 // NewCipher creates and returns a Cipher.
 // Rabbit key, must be 16 bytes.
-func NewCipher(key []byte) (*Cipher, os.Error) {
-	k := len(key)
-	if k != 16 {
+func NewCipher(key []byte) (*Cipher, error) {
+	c := new(Cipher)
+	if err := c.SetKey(key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCipherTrackIVs creates and returns a Cipher that remembers every iv
+// given to SetupIV and returns ErrIVReuse, leaving the state unchanged, if
+// one repeats under the same key; SetKey and Reset forget them. This is a
+// best-effort guard against the key stream reuse that a repeated IV causes,
+// not a guarantee: it only sees IVs set on this Cipher, not on its clones
+// or on other ciphers with the same key, nor rewinds with ResetCipher,
+// RestoreIVState or Seek, and the set is not part of MarshalBinary. Each IV
+// costs about 20 bytes of memory that is only released by SetKey or Reset,
+// so it is not suitable for an unbounded number of IVs.
+// Rabbit key, must be 16 bytes.
+func NewCipherTrackIVs(key []byte) (*Cipher, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c.ivs = make(map[[IVSize]byte]struct{})
+	return c, nil
+}
+
+var errRounds = errors.New("crypto/rabbit: fewer than 4 key setup rounds")
+
+// NewCipherRounds creates and returns a Cipher whose key setup iterates
+// the next-state function rounds times instead of the 4 of the
+// specification. Rounds must be at least 4, or 0 for the standard 4, and
+// NewCipherRounds(key, 4) is NewCipher(key). Any other value is
+// non-standard: the key stream matches no other Rabbit implementation, and
+// both ends must use the same rounds. The IV setup and SetKey are
+// unaffected; Ratchet keeps using rounds. MarshalBinary does not record
+// them, so UnmarshalBinary goes back to the standard 4.
+// Rabbit key, must be 16 bytes.
+func NewCipherRounds(key []byte, rounds int) (*Cipher, error) {
+	if rounds == 0 {
+		rounds = 4
+	}
+	if rounds < 4 {
+		return nil, errRounds
+	}
+	c := new(Cipher)
+	if err := c.setKey(key, rounds); err != nil {
+		return nil, err
+	}
+	c.rounds = rounds
+	return c, nil
+}
+
+// keyRounds returns the number of key setup rounds Ratchet uses.
+func (c *Cipher) keyRounds() int {
+	if c.rounds == 0 {
+		return 4
+	}
+	return c.rounds
+}
+
+// NewCipherPadded creates and returns a Cipher for a key of at most 16
+// bytes, padding shorter keys with zero bytes. A short key is no stronger
+// than its length, whatever the padding: a 10-byte key gives 80-bit
+// security at best. Prefer NewCipher with a full-size key.
+func NewCipherPadded(key []byte) (*Cipher, error) {
+	if k := len(key); k > KeySize {
 		return nil, KeySizeError(k)
 	}
-	var c Cipher
+	var k [KeySize]byte
+	copy(k[:], key)
+	return NewCipher(k[:])
+}
+
+// SetKey runs the key setup again on an existing Cipher, discarding all of
+// its state, so that it is equivalent to a Cipher newly created by NewCipher.
+// Rabbit key, must be 16 bytes.
+func (c *Cipher) SetKey(key []byte) error {
+	if err := c.setKey(key, 4); err != nil {
+		return err
+	}
+	c.rounds = 0
+	return nil
+}
+
+// setKey runs the key setup with the given number of iterations of the
+// next-state function; the specification uses 4.
+func (c *Cipher) setKey(key []byte, rounds int) error {
+	k := len(key)
+	if !ValidKeySize(k) {
+		return KeySizeError(k)
+	}
 
-	var k0, k1, k2, k3 uint32
-	k0 = uint32(key[ 0]) | uint32(key[ 1])<<8 | uint32(key[ 2])<<16 | uint32(key[ 3])<<24
-	k1 = uint32(key[ 4]) | uint32(key[ 5])<<8 | uint32(key[ 6])<<16 | uint32(key[ 7])<<24
-	k2 = uint32(key[ 8]) | uint32(key[ 9])<<8 | uint32(key[10])<<16 | uint32(key[11])<<24
-	k3 = uint32(key[12]) | uint32(key[13])<<8 | uint32(key[14])<<16 | uint32(key[15])<<24
+	k0 := binary.LittleEndian.Uint32(key[0:])
+	k1 := binary.LittleEndian.Uint32(key[4:])
+	k2 := binary.LittleEndian.Uint32(key[8:])
+	k3 := binary.LittleEndian.Uint32(key[12:])
 
 	c.x[0] = k0
 	c.x[2] = k1
@@ -135,18 +331,18 @@ func NewCipher(key []byte) (*Cipher, os.Error) {
 	c.x[5] = k1<<16 | k0>>16
 	c.x[7] = k2<<16 | k1>>16
 
-	c.c[0] = rotl(k2, 16)
-	c.c[2] = rotl(k3, 16)
-	c.c[4] = rotl(k0, 16)
-	c.c[6] = rotl(k1, 16)
+	c.c[0] = rotl16(k2)
+	c.c[2] = rotl16(k3)
+	c.c[4] = rotl16(k0)
+	c.c[6] = rotl16(k1)
 	c.c[1] = (k0&0xFFFF0000) | (k1&0xFFFF)
 	c.c[3] = (k1&0xFFFF0000) | (k2&0xFFFF)
 	c.c[5] = (k2&0xFFFF0000) | (k3&0xFFFF)
 	c.c[7] = (k3&0xFFFF0000) | (k0&0xFFFF)
 
-	c.carry = false
+	c.carry = 0
 
-	for i := 0; i < 4; i++ {
+	for i := 0; i < rounds; i++ {
 		c.rabbitNext()
 	}
 
@@ -159,23 +355,132 @@ func NewCipher(key []byte) (*Cipher, os.Error) {
 		c.cc[i] = c.c[i]
 	}
 	c.ccarry = c.carry
+	c.saveIV()
+	c.r, c.rn = [16]byte{}, 0
+	c.keyed = true
+	clear(c.ivs)
+
+	return nil
+}
+
+// NewCipherWithIV creates and returns a Cipher with the Initialization
+// vector already set up. It is equivalent to NewCipher followed by SetupIV.
+// Rabbit key, must be 16 bytes. Rabbit iv, must be 8 bytes or empty.
+func NewCipherWithIV(key, iv []byte) (*Cipher, error) {
+	if k := len(key); !ValidKeySize(k) {
+		return nil, KeySizeError(k)
+	}
+	if k := len(iv); k != 0 && !ValidIVSize(k) {
+		return nil, IVSizeError(k)
+	}
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.SetupIV(iv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCipherAt creates and returns a Cipher with the Initialization vector
+// set up and positioned offset bytes into its key stream, as NewCipherWithIV
+// followed by Seek. Ciphers started at adjacent offsets, for example by
+// workers sharing one stream, produce output that concatenates to that of
+// a single Cipher.
+func NewCipherAt(key, iv []byte, offset uint64) (*Cipher, error) {
+	c, err := NewCipherWithIV(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	c.Seek(offset)
+	return c, nil
+}
+
+// Encrypt encrypts data with a new Cipher for key and iv and returns the
+// ciphertext in a new slice; data is not modified. Every call starts the key
+// stream afresh, so an iv must never be used twice with the same key. The
+// iv is required: with none, every call under a key would reuse the same
+// key stream.
+// Rabbit key, must be 16 bytes. Rabbit iv, must be 8 bytes.
+func Encrypt(key, iv, data []byte) ([]byte, error) {
+	if k := len(iv); !ValidIVSize(k) {
+		return nil, IVSizeError(k)
+	}
+	c, err := NewCipherWithIV(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	c.xorKeyStream(out, data)
+	return out, nil
+}
 
-	return &c, nil
+// Decrypt decrypts data produced by Encrypt with the same key and iv and
+// returns the plaintext in a new slice. As Rabbit is a stream cipher this
+// is the same operation as Encrypt.
+func Decrypt(key, iv, data []byte) ([]byte, error) {
+	return Encrypt(key, iv, data)
+}
+
+// NewCipherStrict is like NewCipherWithIV, but as a guard against
+// uninitialized buffers it also rejects an all-zero key with ErrZeroKey and
+// an all-zero iv with ErrZeroIV. The iv must be 8 bytes; an empty iv is an
+// IVSizeError here.
+func NewCipherStrict(key, iv []byte) (*Cipher, error) {
+	if k := len(key); !ValidKeySize(k) {
+		return nil, KeySizeError(k)
+	}
+	if k := len(iv); !ValidIVSize(k) {
+		return nil, IVSizeError(k)
+	}
+	if allZero(key) {
+		return nil, ErrZeroKey
+	}
+	if allZero(iv) {
+		return nil, ErrZeroIV
+	}
+	return NewCipherWithIV(key, iv)
+}
+
+func allZero(b []byte) bool {
+	var v byte
+	for _, x := range b {
+		v |= x
+	}
+	return v == 0
 }
 
 // SetupIV will setup Initialization vector.
-// Rabbit iv, must be 8 bytes.
-func (c *Cipher) SetupIV(iv []byte) os.Error {
+// Rabbit iv, must be 8 bytes, or empty for no IV: SetupIV(nil) restores
+// the key-only state exactly as ResetCipher does.
+// The IV is always applied to the saved key-only state, never to the current
+// one, so SetupIV may be called any number of times on one Cipher: the key
+// stream that follows is the same as for a new Cipher given only this IV.
+func (c *Cipher) SetupIV(iv []byte) error {
+	if !c.keyed {
+		return ErrNoKey
+	}
 	k := len(iv)
-	if k != 8 {
+	if k == 0 {
+		c.ResetCipher()
+		return nil
+	}
+	if !ValidIVSize(k) {
 		return IVSizeError(k)
 	}
+	if c.ivs != nil {
+		v := [IVSize]byte(iv)
+		if _, ok := c.ivs[v]; ok {
+			return ErrIVReuse
+		}
+		c.ivs[v] = struct{}{}
+	}
 
-	var d0, d1, d2, d3 uint32
-	d0 = uint32(iv[0]) | uint32(iv[1])<<8 | uint32(iv[2])<<16 | uint32(iv[3])<<24
-	d2 = uint32(iv[4]) | uint32(iv[5])<<8 | uint32(iv[6])<<16 | uint32(iv[7])<<24
-	d1 = d0>>16 | (d2&0xFFFF0000)
-	d3 = d2<<16 | (d0&0x0000FFFF)
+	d0 := binary.LittleEndian.Uint32(iv[0:])
+	d2 := binary.LittleEndian.Uint32(iv[4:])
+	d1 := d0>>16 | (d2&0xFFFF0000)
+	d3 := d2<<16 | (d0&0x0000FFFF)
 
 	c.c[0] = c.cc[0] ^ d0
 	c.c[1] = c.cc[1] ^ d1
@@ -190,72 +495,356 @@ func (c *Cipher) SetupIV(iv []byte) os.Error {
 		c.x[i] = c.cx[i]
 	}
 	c.carry = c.ccarry
-	c.r = nil
+	c.rn = 0
 
 	for i := 0; i < 4; i++ {
 		c.rabbitNext()
 	}
+	c.saveIV()
 
 	return nil
 }
 
+// SetupIVUint64 will setup the Initialization vector given by the 8-byte
+// little-endian encoding of n, for callers deriving IVs from a counter.
+// It returns the errors of SetupIV: ErrNoKey, or ErrIVReuse on a Cipher
+// from NewCipherTrackIVs if n was already used.
+func (c *Cipher) SetupIVUint64(n uint64) error {
+	var iv [8]byte
+	binary.LittleEndian.PutUint64(iv[:], n)
+	return c.SetupIV(iv[:])
+}
+
+// saveIV records the current state as the start of the key stream, the
+// position Seek measures offsets from.
+func (c *Cipher) saveIV() {
+	c.ix, c.ic, c.icarry = c.x, c.c, c.carry
+	c.count = 0
+}
+
+// rabbitGen advances the cipher state and stores the next 16 bytes
+// of key stream in b.
+func (c *Cipher) rabbitGen(b *[16]byte) {
+	c.rabbitNext()
+
+	o0 := c.x[0] ^ (c.x[5]>>16 ^ c.x[3]<<16)
+	o1 := c.x[2] ^ (c.x[7]>>16 ^ c.x[5]<<16)
+	o2 := c.x[4] ^ (c.x[1]>>16 ^ c.x[7]<<16)
+	o3 := c.x[6] ^ (c.x[3]>>16 ^ c.x[1]<<16)
+	binary.LittleEndian.PutUint32(b[0:], o0)
+	binary.LittleEndian.PutUint32(b[4:], o1)
+	binary.LittleEndian.PutUint32(b[8:], o2)
+	binary.LittleEndian.PutUint32(b[12:], o3)
+}
+
+// rabbitGen64 advances the cipher state and returns the next 16 bytes of
+// key stream as two little-endian 64-bit words.
+func (c *Cipher) rabbitGen64() (uint64, uint64) {
+	c.rabbitNext()
+
+	o0 := c.x[0] ^ (c.x[5]>>16 ^ c.x[3]<<16)
+	o1 := c.x[2] ^ (c.x[7]>>16 ^ c.x[5]<<16)
+	o2 := c.x[4] ^ (c.x[1]>>16 ^ c.x[7]<<16)
+	o3 := c.x[6] ^ (c.x[3]>>16 ^ c.x[1]<<16)
+	return uint64(o0) | uint64(o1)<<32, uint64(o2) | uint64(o3)<<32
+}
+
+// checkKeyed panics if c has no key. Without one the key stream would be
+// that of an all-zero state, silently unrelated to any key.
+func (c *Cipher) checkKeyed() {
+	if !c.keyed {
+		panic("crypto/rabbit: use of Cipher without a key")
+	}
+}
+
+// acquire marks c as in use by a method that produces or skips key stream,
+// panicking if c has no key or is already in use; the caller must defer
+// release. Every such method goes through acquire, so a Cipher may panic if
+// it detects concurrent use; calls that do not overlap in time pass
+// unnoticed.
+func (c *Cipher) acquire() {
+	c.checkKeyed()
+	if !c.busy.CompareAndSwap(0, 1) {
+		panic("crypto/rabbit: concurrent use of Cipher")
+	}
+}
+
+// release undoes acquire. Deferred, it also runs if the guarded code
+// panics, so a recovered panic does not leave c marked as in use.
+func (c *Cipher) release() {
+	c.busy.Store(0)
+}
+
+// xorKeyStream XORs src with the key stream into dst. The last block of
+// key stream is kept in c.r, with its c.rn unused bytes at the end, for
+// the next call.
+func (c *Cipher) xorKeyStream(dst, src []byte) {
+	c.acquire()
+	defer c.release()
+	l := len(src)
+	i := 0
+	if m := c.rn; m > 0 {
+		for k := 16 - m; i < m && i < l; i++ {
+			dst[i] = src[i] ^ c.r[k+i]
+		}
+		c.rn -= i
+	}
+	for ; l-i >= 16; i += 16 {
+		k0, k1 := c.rabbitGen64()
+		d, s := dst[i:i+16], src[i:i+16]
+		binary.LittleEndian.PutUint64(d, binary.LittleEndian.Uint64(s)^k0)
+		binary.LittleEndian.PutUint64(d[8:], binary.LittleEndian.Uint64(s[8:])^k1)
+	}
+	if n := l - i; n > 0 {
+		c.rabbitGen(&c.r)
+		for j := 0; j < n; j++ {
+			dst[i+j] = src[i+j] ^ c.r[j]
+		}
+		c.rn = 16 - n
+	}
+	c.count += uint64(l)
+}
+
 // ProcessStream will encrypt or decrypt given buffer.
+// Calls may have any length; a partial block is buffered for the next call.
+// While every call is a multiple of 16 bytes nothing is ever buffered, and
+// ProcessStream never allocates.
 func (c *Cipher) ProcessStream(buf []byte) {
-	l := len(buf)
-	i := 0
-	if m := len(c.r); m > 0 {
-		for ; i < m && i < l; i++ {
-			buf[i] ^= c.r[i]
+	c.xorKeyStream(buf, buf)
+}
+
+// ProcessStreams will encrypt or decrypt each buffer in bufs in turn, as
+// if they were one contiguous buffer.
+func (c *Cipher) ProcessStreams(bufs [][]byte) {
+	for _, buf := range bufs {
+		c.xorKeyStream(buf, buf)
+	}
+}
+
+// ProcessStreamCRC will encrypt or decrypt buf like ProcessStream and
+// return the IEEE CRC-32 of its contents afterwards, as computed by
+// crc32.ChecksumIEEE. When decrypting that is the CRC of the plaintext, so
+// a receiver can check a plaintext checksum without a second pass over
+// the data; when encrypting it is the CRC of the ciphertext. The buffer is
+// processed in small chunks so each is checksummed while still in cache.
+func (c *Cipher) ProcessStreamCRC(buf []byte) uint32 {
+	var crc uint32
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > 4096 {
+			n = 4096
 		}
-		c.r = nil
+		c.xorKeyStream(buf[:n], buf[:n])
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		buf = buf[n:]
 	}
-	for i < l {
-		c.rabbitNext()
+	return crc
+}
 
-		if n := l - i; n >= 16 {
-			o0 := c.x[0] ^ (c.x[5]>>16 ^ c.x[3]<<16)
-			o1 := c.x[2] ^ (c.x[7]>>16 ^ c.x[5]<<16)
-			o2 := c.x[4] ^ (c.x[1]>>16 ^ c.x[7]<<16)
-			o3 := c.x[6] ^ (c.x[3]>>16 ^ c.x[1]<<16)
-			buf[i + 0] ^= byte(o0     )
-			buf[i + 1] ^= byte(o0 >> 8)
-			buf[i + 2] ^= byte(o0 >>16)
-			buf[i + 3] ^= byte(o0 >>24)
-			buf[i + 4] ^= byte(o1     )
-			buf[i + 5] ^= byte(o1 >> 8)
-			buf[i + 6] ^= byte(o1 >>16)
-			buf[i + 7] ^= byte(o1 >>24)
-			buf[i + 8] ^= byte(o2     )
-			buf[i + 9] ^= byte(o2 >> 8)
-			buf[i +10] ^= byte(o2 >>16)
-			buf[i +11] ^= byte(o2 >>24)
-			buf[i +12] ^= byte(o3     )
-			buf[i +13] ^= byte(o3 >> 8)
-			buf[i +14] ^= byte(o3 >>16)
-			buf[i +15] ^= byte(o3 >>24)
-			i += 16
-		} else {
-			for b, j, z, f := buf, 0, c.x[0] ^ (c.x[5]>>16 ^ c.x[3]<<16), false; j < 4; j++ {
-				for k := uint32(0); k < 4; k++ {
-					b[i] ^= byte(z>>(k*8))
-					if i++; f == false && i >= l {
-						l = (3 - j)*4 + (3 - int(k))
-						if l == 0 { return }
-						c.r = make([]byte, l)
-						b, i, f = c.r, 0, true
-					}
-				}
-				switch(j) {
-				case  0: z = c.x[2] ^ (c.x[7]>>16 ^ c.x[5]<<16)
-				case  1: z = c.x[4] ^ (c.x[1]>>16 ^ c.x[7]<<16)
-				case  2: z = c.x[6] ^ (c.x[3]>>16 ^ c.x[1]<<16)
-				}
-			}
+// ProcessStreamWipe will decrypt buf like ProcessStream and return a
+// function that zeroes buf, for the caller to defer once done with the
+// plaintext:
+//
+//	defer c.ProcessStreamWipe(buf)()
+//
+// Zeroing only covers buf itself; copies the caller makes are not wiped.
+func (c *Cipher) ProcessStreamWipe(buf []byte) func() {
+	c.xorKeyStream(buf, buf)
+	return func() {
+		for i := range buf {
+			buf[i] = 0
 		}
 	}
 }
 
-// ResetCipher reset cipher round to original state. Initialization vector will be erased.
+// ProcessStreamChecked is like ProcessStream, but if processing buf would
+// take the key stream past MaxStreamLength bytes, it returns ErrStreamLimit
+// and leaves buf and the cipher unchanged. A new IV starts a new stream.
+func (c *Cipher) ProcessStreamChecked(buf []byte) error {
+	if uint64(len(buf)) > MaxStreamLength-c.count {
+		return ErrStreamLimit
+	}
+	c.xorKeyStream(buf, buf)
+	return nil
+}
+
+// ProcessSmall will encrypt or decrypt buf like ProcessStream, for
+// buffers of at most 16 bytes: it uses any buffered key stream and then
+// generates at most one block, buffering what is left of it, without the
+// whole-block path of ProcessStream. It panics if len(buf) > 16.
+func (c *Cipher) ProcessSmall(buf []byte) {
+	if len(buf) > 16 {
+		panic("crypto/rabbit: ProcessSmall buffer longer than 16 bytes")
+	}
+	c.acquire()
+	defer c.release()
+	i := 0
+	if m := c.rn; m > 0 {
+		for k := 16 - m; i < m && i < len(buf); i++ {
+			buf[i] ^= c.r[k+i]
+		}
+		c.rn -= i
+	}
+	switch n := len(buf) - i; {
+	case n == 16:
+		k0, k1 := c.rabbitGen64()
+		binary.LittleEndian.PutUint64(buf, binary.LittleEndian.Uint64(buf)^k0)
+		binary.LittleEndian.PutUint64(buf[8:], binary.LittleEndian.Uint64(buf[8:])^k1)
+	case n > 0:
+		c.rabbitGen(&c.r)
+		for j := 0; j < n; j++ {
+			buf[i+j] ^= c.r[j]
+		}
+		c.rn = 16 - n
+	}
+	c.count += uint64(len(buf))
+}
+
+// ProcessByte will encrypt or decrypt a single byte, returning b XORed
+// with the next byte of key stream. It shares the buffered block with
+// ProcessStream, so n calls to ProcessByte equal one ProcessStream of n
+// bytes, and calls of the two may be mixed freely.
+func (c *Cipher) ProcessByte(b byte) byte {
+	c.acquire()
+	defer c.release()
+	if c.rn == 0 {
+		c.rabbitGen(&c.r)
+		c.rn = 16
+	}
+	b ^= c.r[16-c.rn]
+	c.rn--
+	c.count++
+	return b
+}
+
+// ProcessStreamTo will encrypt or decrypt src into dst, leaving src
+// unchanged. Dst and src may overlap entirely or not at all. It panics if
+// dst is shorter than src. Dst need not be aligned or on the heap: it may
+// be a writable memory mapping of a file, and each byte of it is written
+// exactly once, with ordinary stores.
+func (c *Cipher) ProcessStreamTo(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("crypto/rabbit: output smaller than input")
+	}
+	c.xorKeyStream(dst[:len(src)], src)
+}
+
+// XORKeyStream XORs each byte in src with a byte from the key stream and
+// writes the result to dst, implementing crypto/cipher.Stream.
+// Dst and src may overlap entirely or not at all.
+func (c *Cipher) XORKeyStream(dst, src []byte) {
+	c.ProcessStreamTo(dst, src)
+}
+
+// Keystream returns the next n bytes of key stream, advancing the cipher
+// exactly as ProcessStream would for a buffer of n bytes.
+func (c *Cipher) Keystream(n int) []byte {
+	b := make([]byte, n)
+	c.xorKeyStream(b, b)
+	return b
+}
+
+// PeekKeystream returns the next n bytes of key stream without consuming
+// them: it works on a copy of c, so the state of c is not changed and the
+// next n bytes processed are XORed with exactly these bytes.
+func (c *Cipher) PeekKeystream(n int) []byte {
+	d := c.clone()
+	b := d.Keystream(n)
+	d.Reset()
+	return b
+}
+
+// KeystreamHex is like Keystream, but returns the bytes as lowercase hex,
+// for debugging and comparison with published test vectors. The bytes are
+// in stream order, as in the eSTREAM vectors; RFC 4503 instead prints each
+// 16-byte block as a big-endian number, so its strings are byte-reversed.
+func (c *Cipher) KeystreamHex(n int) string {
+	return hex.EncodeToString(c.Keystream(n))
+}
+
+// BytesProcessed returns the number of key stream bytes used since the
+// last key or IV setup, ResetCipher or SaveIVState, that is, the current
+// offset in the key stream. It counts bytes processed by every method,
+// whole blocks for GenerateKeystream and NextBlock, and is set by Seek.
+func (c *Cipher) BytesProcessed() uint64 {
+	return c.count
+}
+
+// Counter returns the current counter words and carry bit of the
+// cipher's counter system. Note that the counter is not the whole state:
+// the key stream also depends on the internal state words, which Counter
+// does not return.
+func (c *Cipher) Counter() ([8]uint32, bool) {
+	return c.c, c.carry != 0
+}
+
+// SetCounter sets the counter words and carry bit, leaving the internal
+// state words and any buffered key stream unchanged. The key stream stays
+// consistent only if counter and carry were read by Counter from a cipher
+// with the same key, IV and position, that is, with the same internal
+// state; any other value yields a key stream unrelated to any key. When
+// the whole state must be saved, use MarshalBinary instead.
+func (c *Cipher) SetCounter(counter [8]uint32, carry bool) {
+	c.c = counter
+	c.carry = 0
+	if carry {
+		c.carry = 1
+	}
+}
+
+// SamePosition reports whether c and other are at the same point of the
+// same key stream, that is, whether they will produce identical output
+// from here on. It compares the live state and any buffered key stream,
+// not the saved key and IV states, so it is meant for tracking down where
+// an encrypting and a decrypting Cipher fall out of step.
+func (c *Cipher) SamePosition(other *Cipher) bool {
+	return c.x == other.x && c.c == other.c && c.carry == other.carry &&
+		c.rn == other.rn && string(c.r[16-c.rn:]) == string(other.r[16-other.rn:])
+}
+
+// PendingBytes returns the number of key stream bytes buffered from the
+// last partial block, which the next call to ProcessStream will use first.
+func (c *Cipher) PendingBytes() int {
+	return c.rn
+}
+
+// NextBlock advances the cipher by exactly one block and returns its 16
+// bytes of key stream. Like GenerateKeystream it bypasses the partial block
+// buffered by ProcessStream: mixed with ProcessStream it only continues the
+// same key stream when PendingBytes is zero.
+func (c *Cipher) NextBlock() [16]byte {
+	c.acquire()
+	defer c.release()
+	var b [16]byte
+	c.rabbitGen(&b)
+	c.count += 16
+	return b
+}
+
+// GenerateKeystream fills dst with whole blocks of key stream, generated
+// straight into dst. It is meant for advanced use: it neither consumes nor
+// refills the partial block buffered by ProcessStream, so it only continues
+// the same key stream when no bytes are buffered, and if len(dst) is not a
+// multiple of 16 the rest of the last block is discarded. There is no
+// alignment requirement on dst, which may also be memory-mapped.
+func (c *Cipher) GenerateKeystream(dst []byte) {
+	c.acquire()
+	defer c.release()
+	c.count += uint64(len(dst)+15) &^ 15
+	for len(dst) >= 16 {
+		c.rabbitGen((*[16]byte)(dst))
+		dst = dst[16:]
+	}
+	if len(dst) > 0 {
+		var b [16]byte
+		c.rabbitGen(&b)
+		copy(dst, b[:])
+	}
+}
+
+// ResetCipher reset cipher round to original state. Initialization vector will be erased,
+// and any buffered key stream from a partial block is discarded. Use
+// RestoreIVState to go back to the start of the key stream for the current IV.
 func (c *Cipher) ResetCipher() {
 	for i := range c.c {
 		c.c[i] = c.cc[i]
@@ -264,15 +853,285 @@ func (c *Cipher) ResetCipher() {
 		c.x[i] = c.cx[i]
 	}
 	c.carry = c.ccarry
-	c.r = nil
+	c.rn = 0
+	c.saveIV()
+}
+
+// Seek moves the cipher to offset bytes from the start of the key stream
+// set up by the last call to SetupIV or SaveIVState, or by NewCipher if
+// there was none.
+// The resulting state is identical to processing offset bytes right after
+// that setup. Since ResetCipher erases the Initialization vector, after
+// ResetCipher offsets are measured from the key-only key stream.
+//
+// Rabbit has no way to jump ahead: Seek runs the next-state function once
+// for every 16-byte block before offset, so it costs about as much as
+// generating offset bytes of key stream.
+func (c *Cipher) Seek(offset uint64) {
+	c.acquire()
+	defer c.release()
+	c.x, c.c, c.carry = c.ix, c.ic, c.icarry
+	c.rn = 0
+	c.count = 0
+	c.advance(offset)
+}
+
+// SaveIVState records the current state as the one RestoreIVState returns
+// to. SetupIV already does this, so SaveIVState is only needed to mark a
+// later point, such as after a header has been processed. Any buffered key
+// stream from a partial block is discarded first, so the saved point is a
+// block boundary; call it only after a multiple of 16 bytes to keep the key
+// stream unchanged.
+func (c *Cipher) SaveIVState() {
+	c.rn = 0
+	c.saveIV()
+}
+
+// RestoreIVState returns the cipher to the state right after the last
+// SetupIV or SaveIVState, without repeating the IV setup rounds. It lets
+// several independent messages be processed under the same IV; unlike
+// ResetCipher it keeps the Initialization vector.
+func (c *Cipher) RestoreIVState() {
+	c.x, c.c, c.carry = c.ix, c.ic, c.icarry
+	c.rn = 0
+	c.count = 0
+}
+
+// SkipKeystream advances the cipher exactly as if n bytes had been
+// processed by ProcessStream, without producing any output.
+func (c *Cipher) SkipKeystream(n int) {
+	if n < 0 {
+		panic("crypto/rabbit: negative skip length")
+	}
+	c.skip(uint64(n))
+}
+
+// skip advances the cipher by n bytes of key stream without producing output.
+func (c *Cipher) skip(n uint64) {
+	c.acquire()
+	defer c.release()
+	c.advance(n)
+}
+
+// advance is skip for a caller that already holds c with acquire.
+func (c *Cipher) advance(n uint64) {
+	c.count += n
+	if m := uint64(c.rn); m > 0 {
+		if n < m {
+			c.rn -= int(n)
+			return
+		}
+		n -= m
+		c.rn = 0
+	}
+	for ; n >= 16; n -= 16 {
+		c.rabbitNext()
+	}
+	if n > 0 {
+		c.rabbitGen(&c.r)
+		c.rn = 16 - int(n)
+	}
+}
+
+// Clone returns an independent copy of the cipher, including its saved
+// key and Initialization vector state and any buffered key stream. For a
+// Cipher from NewCipherTrackIVs the copy has its own copy of the used IVs.
+func (c *Cipher) Clone() *Cipher {
+	d := c.clone()
+	if c.ivs != nil {
+		d.ivs = maps.Clone(c.ivs)
+	}
+	return d
+}
+
+// clone is Clone without the set of used IVs, for the internal copies that
+// never escape.
+func (c *Cipher) clone() *Cipher {
+	d := &Cipher{
+		x: c.x, c: c.c, cx: c.cx, cc: c.cc, ix: c.ix, ic: c.ic,
+		carry: c.carry, ccarry: c.ccarry, icarry: c.icarry,
+		r: c.r, rn: c.rn, count: c.count, keyed: c.keyed, rounds: c.rounds,
+	}
+	return d
+}
+
+// DeriveKey returns n bytes of key material for the given context, for
+// deriving separate keys, such as encryption and MAC keys, from the key of
+// c. It is the key stream for an IV made of the first 8 bytes of the
+// SHA-256 hash of context, so the output depends only on the key and the
+// context. The state of c is not changed. This is a simple KDF for key
+// separation, not a replacement for HKDF: the key must already be uniformly
+// random, and distinct contexts must hash to distinct IVs.
+func (c *Cipher) DeriveKey(context []byte, n int) []byte {
+	h := sha256.Sum256(context)
+	d := c.clone()
+	d.SetupIV(h[:IVSize])
+	k := d.Keystream(n)
+	d.Reset()
+	return k
+}
+
+// VerifyPrefix reports whether ciphertext, decrypted from the current
+// position, starts with prefix. Only len(prefix) bytes are decrypted, on a
+// copy of the cipher, so the state of c is not changed. It is a quick check
+// that the key and IV are right before decrypting a whole message.
+func (c *Cipher) VerifyPrefix(ciphertext, prefix []byte) bool {
+	if len(ciphertext) < len(prefix) {
+		return false
+	}
+	d := c.clone()
+	p := make([]byte, len(prefix))
+	d.xorKeyStream(p, ciphertext[:len(prefix)])
+	d.Reset()
+	return tagEqual(p, prefix)
+}
+
+// Version 1 of the state encoding has no byte count.
+const (
+	stateVersion = 2
+	stateSizeV1  = 1 + 6*8*4 + 2
+	stateSize    = stateSizeV1 + 8
+)
+
+var errStateEncoding = errors.New("crypto/rabbit: invalid state encoding")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding holds
+// key-derived state and must be protected like the key itself.
+func (c *Cipher) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, stateSize+c.rn)
+	b = append(b, stateVersion)
+	for _, a := range []*[8]uint32{&c.x, &c.c, &c.cx, &c.cc, &c.ix, &c.ic} {
+		for _, v := range a {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+	}
+	b = binary.LittleEndian.AppendUint64(b, c.count)
+	b = append(b, byte(c.carry|c.ccarry<<1|c.icarry<<2))
+	b = append(b, byte(c.rn))
+	b = append(b, c.r[16-c.rn:]...)
+	return b, nil
 }
 
-// Reset zeros the key data so that it will no longer appear in the
-// process's memory.
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, restoring a state
+// produced by MarshalBinary.
+func (c *Cipher) UnmarshalBinary(data []byte) error {
+	size := stateSize
+	if len(data) > 0 && data[0] == 1 {
+		size = stateSizeV1
+	} else if len(data) > 0 && data[0] != stateVersion {
+		return errStateEncoding
+	}
+	if len(data) < size {
+		return errStateEncoding
+	}
+	f, n := data[size-2], int(data[size-1])
+	if f > 7 || n > 15 || len(data) != size+n {
+		return errStateEncoding
+	}
+	b := data[1:]
+	for _, a := range []*[8]uint32{&c.x, &c.c, &c.cx, &c.cc, &c.ix, &c.ic} {
+		for i := range a {
+			a[i] = binary.LittleEndian.Uint32(b)
+			b = b[4:]
+		}
+	}
+	c.count = 0
+	if size == stateSize {
+		c.count = binary.LittleEndian.Uint64(b)
+	}
+	c.carry, c.ccarry, c.icarry = uint32(f&1), uint32(f>>1&1), uint32(f>>2&1)
+	copy(c.r[16-n:], data[size:])
+	c.rn = n
+	c.keyed = true
+	c.rounds = 0
+	return nil
+}
+
+const (
+	positionVersion = 1
+	positionSize    = 1 + 2*8*4 + 8 + 2
+)
+
+var errPositionToken = errors.New("crypto/rabbit: invalid position token")
+
+// PositionToken returns a compact encoding of the current key stream
+// position: the working state, the carry and any pending key stream. Unlike
+// MarshalBinary it leaves out the saved key-only and IV states, so it is
+// less than half the size and cannot be used to set up other IVs. It is
+// still secret: the working state alone generates the rest of the key
+// stream for the current IV, without the key, so a token must be protected
+// like the key stream it stands for.
+func (c *Cipher) PositionToken() []byte {
+	b := make([]byte, 0, positionSize+c.rn)
+	b = append(b, positionVersion)
+	for _, a := range []*[8]uint32{&c.x, &c.c} {
+		for _, v := range a {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+	}
+	b = binary.LittleEndian.AppendUint64(b, c.count)
+	b = append(b, byte(c.carry))
+	b = append(b, byte(c.rn))
+	b = append(b, c.r[16-c.rn:]...)
+	return b
+}
+
+// RestorePosition moves c to the key stream position encoded in token by
+// PositionToken, normally on a Cipher with the same key. The saved key-only
+// and IV states of c are kept, so ResetCipher and SetupIV behave as before.
+// It returns ErrNoKey if c has no key, and an error, leaving c unchanged,
+// if token is malformed.
+func (c *Cipher) RestorePosition(token []byte) error {
+	if !c.keyed {
+		return ErrNoKey
+	}
+	if len(token) < positionSize || token[0] != positionVersion {
+		return errPositionToken
+	}
+	f, n := token[positionSize-2], int(token[positionSize-1])
+	if f > 1 || n > 15 || len(token) != positionSize+n {
+		return errPositionToken
+	}
+	b := token[1:]
+	for _, a := range []*[8]uint32{&c.x, &c.c} {
+		for i := range a {
+			a[i] = binary.LittleEndian.Uint32(b)
+			b = b[4:]
+		}
+	}
+	c.count = binary.LittleEndian.Uint64(b)
+	c.carry = uint32(f)
+	copy(c.r[16-n:], token[positionSize:])
+	c.rn = n
+	return nil
+}
+
+// String returns a fixed description of the cipher, so that formatting a
+// Cipher with fmt never reveals its key-derived state.
+func (c *Cipher) String() string {
+	return "rabbit.Cipher{...}"
+}
+
+// GoString is like String, for the %#v verb.
+func (c *Cipher) GoString() string {
+	return "&rabbit.Cipher{...}"
+}
+
+// Reset zeros the key data, including any buffered key stream, so that it
+// will no longer appear in the process's memory. The Cipher then has no key
+// and must be given one with SetKey before it is used again.
 func (c *Cipher) Reset() {
 	for i := range c.x {
 		c.x[i], c.c[i], c.cx[i], c.cc[i] = 0, 0, 0, 0
+		c.ix[i], c.ic[i] = 0, 0
+	}
+	c.carry, c.ccarry, c.icarry = 0, 0, 0
+	c.count = 0
+	for i := range c.r {
+		c.r[i] = 0
 	}
-	c.carry, c.carry = false, false
+	c.rn = 0
+	c.keyed = false
+	clear(c.ivs)
 }
 
@@ -5,6 +5,15 @@
 package rabbit
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -4719,3 +4728,1838 @@ func TestCipher(t *testing.T) {
 	}
 }
 
+
+func TestXORKeyStream(t *testing.T) {
+	for i := range testVectors {
+		r := testVectors[i]
+		c1, err := NewCipher(r.key)
+		if err != nil {
+			t.Fatalf("testVectors [%d]: Failed to create cipher", i)
+		}
+		c2, _ := NewCipher(r.key)
+		c1.SetupIV(r.iv)
+		c2.SetupIV(r.iv)
+		src := make([]byte, r.zero)
+		dst := make([]byte, r.zero)
+		want := make([]byte, r.zero)
+		for j, k, l, m := 0, 0, 1, r.zero; k < m; j++ {
+			l += j
+			if k+l > m {
+				l = m - k
+			}
+			c1.XORKeyStream(dst[k:k+l], src[k:k+l])
+			k += l
+		}
+		c2.ProcessStream(want)
+		for j, v := range src {
+			if v != 0 {
+				t.Fatalf("testVectors [%d]: XORKeyStream modified src[%d] = %#x", i, j, v)
+			}
+		}
+		for j := range want {
+			if dst[j] != want[j] {
+				t.Fatalf("testVectors [%d]: XORKeyStream out[%d] = %#x, want %#x", i, j, dst[j], want[j])
+			}
+		}
+	}
+}
+
+func TestSizeErrors(t *testing.T) {
+	for _, key := range [][]byte{nil, make([]byte, 15), make([]byte, 17)} {
+		if _, err := NewCipher(key); err != KeySizeError(len(key)) {
+			t.Errorf("NewCipher: got error %#v for %d byte key, want KeySizeError(%d)", err, len(key), len(key))
+		}
+	}
+	if _, err := NewCipher(make([]byte, 15)); err == nil {
+		t.Errorf("NewCipher: expected error for 15 byte key")
+	} else if k, ok := err.(KeySizeError); !ok || k != 15 {
+		t.Errorf("NewCipher: got error %#v, want KeySizeError(15)", err)
+	}
+	c, _ := NewCipher(make([]byte, 16))
+	if err := c.SetupIV(make([]byte, 9)); err == nil {
+		t.Errorf("SetupIV: expected error for 9 byte iv")
+	} else if k, ok := err.(IVSizeError); !ok || k != 9 {
+		t.Errorf("SetupIV: got error %#v, want IVSizeError(9)", err)
+	}
+	if _, err := NewCipherWithIV(make([]byte, 32), make([]byte, 8)); !errors.Is(err, ErrKeySize) || errors.Is(err, ErrIVSize) {
+		t.Errorf("NewCipherWithIV: errors.Is(%v, ErrKeySize) failed", err)
+	}
+	if _, err := NewCipherWithIV(make([]byte, 16), make([]byte, 7)); !errors.Is(err, ErrIVSize) || errors.Is(err, ErrKeySize) {
+		t.Errorf("NewCipherWithIV: errors.Is(%v, ErrIVSize) failed", err)
+	}
+}
+
+func TestNewCipherWithIV(t *testing.T) {
+	for i := range testVectors {
+		r := testVectors[i]
+		c1, err := NewCipherWithIV(r.key, r.iv)
+		if err != nil {
+			t.Fatalf("testVectors [%d]: Failed to create cipher: %v", i, err)
+		}
+		c2, _ := NewCipher(r.key)
+		c2.SetupIV(r.iv)
+		b1 := make([]byte, r.zero)
+		b2 := make([]byte, r.zero)
+		c1.ProcessStream(b1)
+		c2.ProcessStream(b2)
+		for j := range b1 {
+			if b1[j] != b2[j] {
+				t.Fatalf("testVectors [%d]: out[%d] = %#x, want %#x", i, j, b1[j], b2[j])
+			}
+		}
+	}
+	if _, err := NewCipherWithIV(make([]byte, 8), make([]byte, 8)); err != KeySizeError(8) {
+		t.Errorf("NewCipherWithIV: got error %#v, want KeySizeError(8)", err)
+	}
+	if _, err := NewCipherWithIV(make([]byte, 16), make([]byte, 16)); err != IVSizeError(16) {
+		t.Errorf("NewCipherWithIV: got error %#v, want IVSizeError(16)", err)
+	}
+}
+
+func TestKeystream(t *testing.T) {
+	r := testVectors[0]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, 100)
+	c1.ProcessStream(want)
+	for _, n := range []int{0, 5, 16, 21, 37, 64, 100} {
+		c2.SetupIV(r.iv)
+		got := c2.Keystream(n)
+		rest := make([]byte, len(want)-n)
+		c2.ProcessStream(rest)
+		got = append(got, rest...)
+		for j := range want {
+			if got[j] != want[j] {
+				t.Fatalf("Keystream(%d): out[%d] = %#x, want %#x", n, j, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	r := testVectors[1]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, r.zero)
+	c.ProcessStream(want)
+	for _, off := range []int{0, 1, 15, 16, 17, 100, 255, 256, r.zero} {
+		c.ProcessStream(make([]byte, 7))
+		c.Seek(uint64(off))
+		d, _ := NewCipherWithIV(r.key, r.iv)
+		d.ProcessStream(make([]byte, off))
+		if got, want := StateOf(c), StateOf(d); got != want {
+			t.Fatalf("Seek(%d): state %+v, want %+v", off, got, want)
+		}
+		got := make([]byte, r.zero-off)
+		c.ProcessStream(got)
+		for j := range got {
+			if got[j] != want[off+j] {
+				t.Fatalf("Seek(%d): out[%d] = %#x, want %#x", off, j, got[j], want[off+j])
+			}
+		}
+	}
+	c2, _ := NewCipher(r.key)
+	want = make([]byte, 64)
+	c2.ProcessStream(want)
+	c.ResetCipher()
+	c.Seek(32)
+	got := make([]byte, 32)
+	c.ProcessStream(got)
+	for j := range got {
+		if got[j] != want[32+j] {
+			t.Fatalf("Seek after ResetCipher: out[%d] = %#x, want %#x", j, got[j], want[32+j])
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	r := testVectors[2]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 37))
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var c2 Cipher
+	if err = c2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if got, want := StateOf(&c2), StateOf(c); got != want {
+		t.Fatalf("UnmarshalBinary: state %+v, want %+v", got, want)
+	}
+	want := make([]byte, 100)
+	got := make([]byte, 100)
+	c.ProcessStream(want)
+	c2.ProcessStream(got)
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("UnmarshalBinary: out[%d] = %#x, want %#x", j, got[j], want[j])
+		}
+	}
+	c.Seek(5)
+	c2.Seek(5)
+	c.ProcessStream(want)
+	c2.ProcessStream(got)
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("UnmarshalBinary: Seek: out[%d] = %#x, want %#x", j, got[j], want[j])
+		}
+	}
+	if c2.BytesProcessed() != c.BytesProcessed() {
+		t.Errorf("UnmarshalBinary: BytesProcessed = %d, want %d", c2.BytesProcessed(), c.BytesProcessed())
+	}
+	v1 := append([]byte{1}, data[1:stateSizeV1-2]...)
+	v1 = append(v1, data[stateSize-2:]...)
+	var c3 Cipher
+	if err = c3.UnmarshalBinary(v1); err != nil {
+		t.Fatalf("UnmarshalBinary of version 1: %v", err)
+	}
+	if n := c3.BytesProcessed(); n != 0 {
+		t.Errorf("UnmarshalBinary of version 1: BytesProcessed = %d, want 0", n)
+	}
+	c.Seek(37)
+	if got, want := c3.Keystream(32), c.Keystream(32); !bytes.Equal(got, want) {
+		t.Fatalf("UnmarshalBinary of version 1: out = %X, want %X", got, want)
+	}
+	for _, bad := range [][]byte{nil, data[:len(data)-1], append([]byte{0xFF}, data[1:]...)} {
+		if err = c2.UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary: expected error for %d byte input", len(bad))
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	r := testVectors[3]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 21))
+	d := c.Clone()
+	if got, want := StateOf(d), StateOf(c); got != want {
+		t.Fatalf("Clone: state %+v, want %+v", got, want)
+	}
+	want := make([]byte, 50)
+	got := make([]byte, 50)
+	c.ProcessStream(want)
+	d.ProcessStream(got)
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("Clone: out[%d] = %#x, want %#x", j, got[j], want[j])
+		}
+	}
+	d = c.Clone()
+	d.ProcessStream(make([]byte, 3))
+	d.ResetCipher()
+	c.ProcessStream(want)
+	c.Seek(71)
+	c.ProcessStream(got)
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("Clone: original changed by copy, out[%d] = %#x, want %#x", j, got[j], want[j])
+		}
+	}
+}
+
+// specVectors are the test vectors from appendix A of RFC 4503, the
+// Rabbit specification. A nil iv means the key-only key stream.
+var specVectors = []struct {
+	key, iv string
+	out     [3]string
+}{
+	{
+		"00000000000000000000000000000000", "",
+		[3]string{
+			"B15754F036A5D6ECF56B45261C4AF702",
+			"88E8D815C59C0C397B696C4789C68AA7",
+			"F416A1C3700CD451DA68D1881673D696",
+		},
+	},
+	{
+		"912813292E3D36FE3BFC62F1DC51C3AC", "",
+		[3]string{
+			"3D2DF3C83EF627A1E97FC38487E2519C",
+			"F576CD61F4405B8896BF53AA8554FC19",
+			"E5547473FBDB43508AE53B20204D4C5E",
+		},
+	},
+	{
+		"8395741587E0C733E9E9AB01C09B0043", "",
+		[3]string{
+			"0CB10DCDA041CDAC32EB5CFD02D0609B",
+			"95FC9FCA0F17015A7B7092114CFF3EAD",
+			"9649E5DE8BFC7F3F924147AD3A947428",
+		},
+	},
+	{
+		"00000000000000000000000000000000", "0000000000000000",
+		[3]string{
+			"C6A7275EF85495D87CCD5D376705B7ED",
+			"5F29A6AC04F5EFD47B8F293270DC4A8D",
+			"2ADE822B29DE6C1EE52BDB8A47BF8F66",
+		},
+	},
+	{
+		"00000000000000000000000000000000", "C373F575C1267E59",
+		[3]string{
+			"1FCD4EB9580012E2E0DCCC9222017D6D",
+			"A75F4E10D12125017B2499FFED936F2E",
+			"EBC112C393E738392356BDD012029BA7",
+		},
+	},
+	{
+		"00000000000000000000000000000000", "A6EB561AD2F41727",
+		[3]string{
+			"445AD8C805858DBF70B6AF23A151104D",
+			"96C8F27947F42C5BAEAE67C6ACC35B03",
+			"9FCBFC895FA71C17313DF034F01551CB",
+		},
+	},
+}
+
+// specBytes decodes a hex string from RFC 4503, which prints keys, IVs and
+// output blocks most significant byte first, into the byte order used by
+// this package.
+func specBytes(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+func TestSpecVectors(t *testing.T) {
+	for i, v := range specVectors {
+		c, err := NewCipher(specBytes(v.key))
+		if err != nil {
+			t.Fatalf("specVectors [%d]: Failed to create cipher", i)
+		}
+		if v.iv != "" {
+			if err = c.SetupIV(specBytes(v.iv)); err != nil {
+				t.Fatalf("specVectors [%d]: Failed to setup Initialization vector", i)
+			}
+		}
+		for j, s := range v.out {
+			want := specBytes(s)
+			got := c.Keystream(16)
+			for k := range want {
+				if got[k] != want[k] {
+					t.Errorf("specVectors [%d]: S[%d] = %X, want %X", i, j, got, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, i := range []int{0, 3, 17} {
+		r := testVectors[i]
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		c.ProcessStream(make([]byte, 21))
+		before := StateOf(c)
+		var zero [8]uint32
+		for _, a := range [][8]uint32{before.X, before.C, before.CX, before.CC, before.IX, before.IC} {
+			if a == zero {
+				t.Fatalf("testVectors [%d]: keyed cipher has an all-zero state array", i)
+			}
+		}
+		c.Reset()
+		if c.r != [16]byte{} {
+			t.Fatalf("testVectors [%d]: Reset: buffered key stream bytes %X not cleared", i, c.r)
+		}
+		s := StateOf(c)
+		for name, a := range map[string][8]uint32{"x": s.X, "c": s.C, "cx": s.CX, "cc": s.CC, "ix": s.IX, "ic": s.IC} {
+			if a != zero {
+				t.Errorf("testVectors [%d]: Reset: %s = %#x, want zero", i, name, a)
+			}
+		}
+		if s.Carry|s.CCarry|s.ICarry != 0 {
+			t.Errorf("testVectors [%d]: Reset: carry = %d, ccarry = %d, icarry = %d, want 0", i, s.Carry, s.CCarry, s.ICarry)
+		}
+		if s != (State{}) {
+			t.Errorf("testVectors [%d]: Reset: state %+v not zeroed", i, s)
+		}
+	}
+}
+
+func TestProcessStreamAllocs(t *testing.T) {
+	r := testVectors[0]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	buf := make([]byte, 37)
+	if n := testing.AllocsPerRun(100, func() { c.ProcessStream(buf[:5]); c.ProcessStream(buf) }); n != 0 {
+		t.Errorf("ProcessStream: %v allocations, want 0", n)
+	}
+}
+
+func TestProcessStreamAligned(t *testing.T) {
+	r := testVectors[8]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	sizes := []int{16, 32, 48}
+	got := make([]byte, 0, 100*48)
+	for i := 0; i < 100; i++ {
+		buf := make([]byte, sizes[i%3])
+		c.ProcessStream(buf)
+		if c.rn != 0 {
+			t.Fatalf("call %d of %d bytes: %d key stream bytes buffered, want 0", i, len(buf), c.rn)
+		}
+		got = append(got, buf...)
+	}
+	want := make([]byte, len(got))
+	d.ProcessStream(want)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("aligned calls: out differs from one call of %d bytes", len(want))
+	}
+	buf := make([]byte, 48)
+	if n := testing.AllocsPerRun(100, func() { c.ProcessStream(buf[:16]); c.ProcessStream(buf) }); n != 0 {
+		t.Errorf("aligned ProcessStream: %v allocations, want 0", n)
+	}
+	if c.rn != 0 {
+		t.Errorf("aligned ProcessStream: %d key stream bytes buffered, want 0", c.rn)
+	}
+}
+
+func TestProcessStreamTo(t *testing.T) {
+	r := testVectors[4]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	src := make([]byte, 99)
+	dst := make([]byte, 128)
+	c1.ProcessStreamTo(dst, src)
+	c2.ProcessStream(src)
+	for j := range src {
+		if dst[j] != src[j] {
+			t.Fatalf("ProcessStreamTo: out[%d] = %#x, want %#x", j, dst[j], src[j])
+		}
+	}
+	for j, v := range dst[len(src):] {
+		if v != 0 {
+			t.Fatalf("ProcessStreamTo: wrote past source length at %d", len(src)+j)
+		}
+	}
+	c1.ProcessStreamTo(dst[:len(src)], dst[:len(src)])
+	c2.ProcessStream(src)
+	for j := range src {
+		if dst[j] != src[j] {
+			t.Fatalf("ProcessStreamTo in place: out[%d] = %#x, want %#x", j, dst[j], src[j])
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("ProcessStreamTo: expected panic for short dst")
+		}
+	}()
+	c1.ProcessStreamTo(dst[:1], src)
+}
+
+// TestByteOrder checks key and key stream bytes against fixed literals: the
+// second key-only vector of RFC 4503, appendix A, with the key read and the
+// output written least significant byte first, as on the wire.
+func TestByteOrder(t *testing.T) {
+	key := []byte{
+		0xac, 0xc3, 0x51, 0xdc, 0xf1, 0x62, 0xfc, 0x3b,
+		0xfe, 0x36, 0x3d, 0x2e, 0x29, 0x13, 0x28, 0x91,
+	}
+	want := []byte{
+		0x9c, 0x51, 0xe2, 0x87, 0x84, 0xc3, 0x7f, 0xe9,
+		0xa1, 0x27, 0xf6, 0x3e, 0xc8, 0xf3, 0x2d, 0x3d,
+		0x19, 0xfc, 0x54, 0x85, 0xaa, 0x53, 0xbf, 0x96,
+		0x88, 0x5b, 0x40, 0xf4, 0x61, 0xcd, 0x76, 0xf5,
+	}
+	c, _ := NewCipher(key)
+	if got := c.Keystream(len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("ByteOrder: out = %X, want %X", got, want)
+	}
+}
+
+func benchmarkProcessStream(b *testing.B, n int) {
+	c, _ := NewCipherWithIV(make([]byte, 16), make([]byte, 8))
+	buf := make([]byte, n)
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.ProcessStream(buf)
+	}
+}
+
+// benchmarkProcessStreamTo is benchmarkProcessStream for the copy-to path,
+// with separate source and destination buffers.
+func benchmarkProcessStreamTo(b *testing.B, n int) {
+	c, _ := NewCipherWithIV(make([]byte, 16), make([]byte, 8))
+	src := make([]byte, n)
+	dst := make([]byte, n)
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.ProcessStreamTo(dst, src)
+	}
+}
+
+func BenchmarkProcessStream7(b *testing.B)   { benchmarkProcessStream(b, 7) }
+func BenchmarkProcessStream16(b *testing.B)  { benchmarkProcessStream(b, 16) }
+func BenchmarkProcessStream1K(b *testing.B)  { benchmarkProcessStream(b, 1<<10) }
+func BenchmarkProcessStream64K(b *testing.B) { benchmarkProcessStream(b, 64<<10) }
+
+func BenchmarkProcessStreamTo7(b *testing.B)   { benchmarkProcessStreamTo(b, 7) }
+func BenchmarkProcessStreamTo16(b *testing.B)  { benchmarkProcessStreamTo(b, 16) }
+func BenchmarkProcessStreamTo1K(b *testing.B)  { benchmarkProcessStreamTo(b, 1<<10) }
+func BenchmarkProcessStreamTo64K(b *testing.B) { benchmarkProcessStreamTo(b, 64<<10) }
+
+func BenchmarkRabbitNext(b *testing.B) {
+	c, _ := NewCipher(testVectors[0].key)
+	b.SetBytes(16)
+	for i := 0; i < b.N; i++ {
+		c.rabbitNext()
+	}
+}
+
+func BenchmarkNewCipherSetupIV(b *testing.B) {
+	key := make([]byte, 16)
+	iv := make([]byte, 8)
+	for i := 0; i < b.N; i++ {
+		c, _ := NewCipher(key)
+		c.SetupIV(iv)
+	}
+}
+
+func TestRotl16(t *testing.T) {
+	rnd := rand.New(rand.NewSource(55))
+	for i := 0; i < 1000; i++ {
+		v := rnd.Uint32()
+		if got, want := rotl16(v), rotl(v, 16); got != want {
+			t.Fatalf("rotl16(%#x) = %#x, want %#x", v, got, want)
+		}
+	}
+}
+
+func BenchmarkNewCipher(b *testing.B) {
+	key := make([]byte, 16)
+	for i := 0; i < b.N; i++ {
+		NewCipher(key)
+	}
+}
+
+func TestValidSizes(t *testing.T) {
+	for n := 0; n <= 32; n++ {
+		_, err := NewCipher(make([]byte, n))
+		if ValidKeySize(n) != (err == nil) || ValidKeySize(n) != (n == KeySize) {
+			t.Errorf("ValidKeySize(%d) = %v, NewCipher error %v", n, ValidKeySize(n), err)
+		}
+		c, _ := NewCipher(make([]byte, KeySize))
+		err = c.SetupIV(make([]byte, n))
+		if ValidIVSize(n) != (n == IVSize) || (ValidIVSize(n) || n == 0) != (err == nil) {
+			t.Errorf("ValidIVSize(%d) = %v, SetupIV error %v", n, ValidIVSize(n), err)
+		}
+	}
+}
+
+func TestSetKey(t *testing.T) {
+	r1, r2 := testVectors[0], testVectors[5]
+	c, _ := NewCipherWithIV(r1.key, r1.iv)
+	c.ProcessStream(make([]byte, 13))
+	if err := c.SetKey(r2.key); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+	d, _ := NewCipher(r2.key)
+	want := d.Keystream(50)
+	got := c.Keystream(50)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("SetKey: out = %X, want %X", got, want)
+	}
+	if err := c.SetKey(r2.key[:5]); err != KeySizeError(5) {
+		t.Errorf("SetKey: got error %#v, want KeySizeError(5)", err)
+	}
+	c.SetKey(r2.key)
+	if n := testing.AllocsPerRun(10, func() { c.SetKey(r2.key) }); n != 0 {
+		t.Errorf("SetKey: %v allocations, want 0", n)
+	}
+}
+
+func TestSkipKeystream(t *testing.T) {
+	r := testVectors[6]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := c.Keystream(r.zero)
+	c.Seek(0)
+	for k, l := 0, 0; k < r.zero; l++ {
+		n := l % 23
+		if k+n > r.zero {
+			n = r.zero - k
+		}
+		if l%2 == 0 {
+			c.SkipKeystream(n)
+		} else if got := c.Keystream(n); !bytes.Equal(got, want[k:k+n]) {
+			t.Fatalf("SkipKeystream: out[%d:%d] = %X, want %X", k, k+n, got, want[k:k+n])
+		}
+		k += n
+	}
+}
+
+func TestGenerateKeystream(t *testing.T) {
+	r := testVectors[7]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := c.Keystream(r.zero)
+	c.Seek(0)
+	got := make([]byte, r.zero)
+	c.GenerateKeystream(got[:64])
+	// The partial block ending at 100 is discarded, so the next
+	// block starts at 112.
+	c.GenerateKeystream(got[64:100])
+	c.GenerateKeystream(got[112:])
+	for _, part := range [][2]int{{0, 100}, {112, r.zero}} {
+		if !bytes.Equal(got[part[0]:part[1]], want[part[0]:part[1]]) {
+			t.Fatalf("GenerateKeystream: out[%d:%d] mismatch", part[0], part[1])
+		}
+	}
+}
+
+// TestCounterCarry checks the branchless counter update against the
+// comparison-based carry of the specification, including states that carry
+// through every counter word.
+func TestCounterCarry(t *testing.T) {
+	a := [8]uint32{
+		0x4D34D34D, 0xD34D34D3, 0x34D34D34, 0x4D34D34D,
+		0xD34D34D3, 0x34D34D34, 0x4D34D34D, 0xD34D34D3,
+	}
+	ref := func(c *[8]uint32, carry uint32) uint32 {
+		for j := range c {
+			t := c[j] + a[j] + carry
+			if t < c[j] || (carry == 1 && t == c[j]) {
+				carry = 1
+			} else {
+				carry = 0
+			}
+			c[j] = t
+		}
+		return carry
+	}
+	var all1, near [8]uint32
+	for j := range all1 {
+		all1[j] = 0xFFFFFFFF
+		near[j] = -a[j]
+	}
+	states := [][8]uint32{{}, all1, near}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		var c [8]uint32
+		for j := range c {
+			c[j] = rnd.Uint32()
+			if rnd.Intn(4) == 0 {
+				c[j] = -a[j] - uint32(rnd.Intn(2))
+			}
+		}
+		states = append(states, c)
+	}
+	for _, st := range states {
+		for carry := uint32(0); carry < 2; carry++ {
+			var c Cipher
+			c.c, c.carry = st, carry
+			c.rabbitNext()
+			want := st
+			wantCarry := ref(&want, carry)
+			if c.c != want || c.carry != wantCarry {
+				t.Fatalf("rabbitNext(%#x, carry %d): counter %#x, carry %d, want %#x, carry %d", st, carry, c.c, c.carry, want, wantCarry)
+			}
+		}
+	}
+}
+
+// BenchmarkRabbitNextCarry and BenchmarkRabbitNextNoCarry time rounds that
+// carry through every counter word against rounds that never carry; with
+// the branchless update they should take the same time.
+func BenchmarkRabbitNextCarry(b *testing.B) {
+	var all1 [8]uint32
+	for i := range all1 {
+		all1[i] = 0xFFFFFFFF
+	}
+	benchmarkRabbitNextCounter(b, all1)
+}
+
+func BenchmarkRabbitNextNoCarry(b *testing.B) {
+	benchmarkRabbitNextCounter(b, [8]uint32{})
+}
+
+func benchmarkRabbitNextCounter(b *testing.B, ctr [8]uint32) {
+	var c Cipher
+	for i := 0; i < b.N; i++ {
+		c.c, c.carry = ctr, 0
+		c.rabbitNext()
+	}
+}
+
+func TestResetCipher(t *testing.T) {
+	r := testVectors[1]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipher(r.key)
+	want := make([]byte, 40)
+	d.ProcessStream(want)
+	for _, n := range []int{1, 15, 17, 37} {
+		c.ProcessStream(make([]byte, n))
+		c.ResetCipher()
+		got := make([]byte, 40)
+		c.ProcessStream(got)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("ResetCipher after %d bytes: out = %X, want %X", n, got, want)
+		}
+	}
+}
+
+func TestSetupIVEmpty(t *testing.T) {
+	r := testVectors[4]
+	d, _ := NewCipher(r.key)
+	want := d.Keystream(40)
+	for _, iv := range [][]byte{nil, {}} {
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		c.ProcessStream(make([]byte, 19))
+		if err := c.SetupIV(iv); err != nil {
+			t.Fatalf("SetupIV(%#v): %v", iv, err)
+		}
+		if got := c.Keystream(40); !bytes.Equal(got, want) {
+			t.Fatalf("SetupIV(%#v): out = %X, want %X", iv, got, want)
+		}
+		c.Seek(3)
+		if got := c.Keystream(37); !bytes.Equal(got, want[3:]) {
+			t.Fatalf("SetupIV(%#v), Seek(3): out = %X, want %X", iv, got, want[3:])
+		}
+	}
+	c, err := NewCipherWithIV(r.key, nil)
+	if err != nil {
+		t.Fatalf("NewCipherWithIV(key, nil): %v", err)
+	}
+	if got := c.Keystream(40); !bytes.Equal(got, want) {
+		t.Fatalf("NewCipherWithIV(key, nil): out = %X, want %X", got, want)
+	}
+}
+
+func TestSetupIVRepeated(t *testing.T) {
+	r := testVectors[2]
+	ivA, ivB := []byte("ivAivAiv"), r.iv
+	c, _ := NewCipherWithIV(r.key, ivA)
+	c.ProcessStream(make([]byte, 29))
+	c.SetupIV(ivB)
+	d, _ := NewCipherWithIV(r.key, ivB)
+	if got, want := c.Keystream(r.zero), d.Keystream(r.zero); !bytes.Equal(got, want) {
+		t.Fatalf("SetupIV(ivA), SetupIV(ivB): key stream differs from SetupIV(ivB)")
+	}
+}
+
+func TestSetupIVUint64(t *testing.T) {
+	r := testVectors[0]
+	c, _ := NewCipher(r.key)
+	d, _ := NewCipher(r.key)
+	for _, n := range []uint64{0, 1, 0x0123456789ABCDEF, 1<<64 - 1} {
+		iv := make([]byte, 8)
+		binary.LittleEndian.PutUint64(iv, n)
+		if err := c.SetupIVUint64(n); err != nil {
+			t.Fatalf("SetupIVUint64(%#x): %v", n, err)
+		}
+		d.SetupIV(iv)
+		if got, want := c.Keystream(32), d.Keystream(32); !bytes.Equal(got, want) {
+			t.Errorf("SetupIVUint64(%#x): out = %X, want %X", n, got, want)
+		}
+	}
+}
+
+func FuzzProcessStreamSplit(f *testing.F) {
+	f.Add([]byte("0123456789abcdef0123456789abcdef0"), 17, 3)
+	f.Add(make([]byte, 48), 16, 32)
+	f.Add([]byte{1}, 0, 1)
+	r := testVectors[0]
+	f.Fuzz(func(t *testing.T, data []byte, i, j int) {
+		if i < 0 || j < 0 {
+			return
+		}
+		i %= len(data) + 1
+		j %= len(data) + 1
+		if i > j {
+			i, j = j, i
+		}
+		c1, _ := NewCipherWithIV(r.key, r.iv)
+		c2, _ := NewCipherWithIV(r.key, r.iv)
+		want := append([]byte(nil), data...)
+		got := append([]byte(nil), data...)
+		c1.ProcessStream(want)
+		c2.ProcessStream(got[:i])
+		c2.ProcessStream(got[i:j])
+		c2.ProcessStream(got[j:])
+		if !bytes.Equal(got, want) {
+			t.Fatalf("split at %d, %d: out = %X, want %X", i, j, got, want)
+		}
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := range testVectors {
+		r := testVectors[i]
+		for _, n := range []int{0, 1, 15, 16, 17, 31, 64, 100, 1000} {
+			plaintext := make([]byte, n)
+			rnd.Read(plaintext)
+			enc, _ := NewCipherWithIV(r.key, r.iv)
+			dec, _ := NewCipherWithIV(r.key, r.iv)
+			buf := append([]byte(nil), plaintext...)
+			enc.ProcessStream(buf)
+			if n >= 16 && bytes.Equal(buf, plaintext) {
+				t.Fatalf("testVectors [%d]: %d bytes: ciphertext equals plaintext", i, n)
+			}
+			dec.ProcessStream(buf)
+			if !bytes.Equal(buf, plaintext) {
+				t.Fatalf("testVectors [%d]: %d bytes: decrypted %X, want %X", i, n, buf, plaintext)
+			}
+		}
+	}
+}
+
+func TestNewCipherPadded(t *testing.T) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	c, err := NewCipherPadded(key)
+	if err != nil {
+		t.Fatalf("NewCipherPadded: %v", err)
+	}
+	d, _ := NewCipher(append(key, 0, 0, 0, 0, 0, 0))
+	if got, want := c.Keystream(32), d.Keystream(32); !bytes.Equal(got, want) {
+		t.Errorf("NewCipherPadded: out = %X, want %X", got, want)
+	}
+	if _, err = NewCipherPadded(make([]byte, 17)); err != KeySizeError(17) {
+		t.Errorf("NewCipherPadded: got error %#v, want KeySizeError(17)", err)
+	}
+	if _, err = NewCipher(key); err != KeySizeError(10) {
+		t.Errorf("NewCipher: got error %#v, want KeySizeError(10)", err)
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	r := testVectors[0]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	total := 0
+	for _, n := range []int{0, 1, 14, 1, 16, 20, 12, 3} {
+		c.Keystream(n)
+		total += n
+		if got, want := c.PendingBytes(), (16-total%16)%16; got != want {
+			t.Fatalf("PendingBytes after %d bytes = %d, want %d", total, got, want)
+		}
+	}
+}
+
+func TestWordPath(t *testing.T) {
+	r := testVectors[5]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	for _, n := range []int{16, 17, 31, 32, 33, 255} {
+		c.Seek(0)
+		want := make([]byte, (n+15)/16*16)
+		c.GenerateKeystream(want)
+		c.Seek(0)
+		got := make([]byte, n)
+		c.ProcessStream(got)
+		if !bytes.Equal(got, want[:n]) {
+			t.Fatalf("ProcessStream(%d): out = %X, want %X", n, got, want[:n])
+		}
+	}
+}
+
+// ivVectors are known answers for key stream at several offsets after IV
+// setup, taken from the eSTREAM Set 5 and Set 6 test vectors.
+var ivVectors = []struct {
+	key, iv string
+	offset  int
+	out     string
+}{
+	{"00000000000000000000000000000000", "0000001000000000", 0, "AD1CEF2DBC992972709AD20046F141DE"},
+	{"00000000000000000000000000000000", "0000001000000000", 16, "692C0A1960425A7E97CD5CA012974946"},
+	{"00000000000000000000000000000000", "0000001000000000", 48, "106F90B8879DA7F5AA59EB0E7B348F67"},
+	{"00000000000000000000000000000000", "0000000008000000", 0, "3A2A8DC611360210D764A8461B18CBB7"},
+	{"00000000000000000000000000000000", "0000000008000000", 16, "C9E7683C14DB3AFADB084220821CC6BC"},
+	{"00000000000000000000000000000000", "0000000008000000", 48, "B2E8F80E987E95EB15995990EE1AEC47"},
+	{"00000000000000000000000000000000", "0000000000000001", 0, "55FB0B90A9FB953AE96D372BADBEBD30"},
+	{"00000000000000000000000000000000", "0000000000000001", 16, "F531A454D31B669BCD8BAAD78C6C9994"},
+	{"00000000000000000000000000000000", "0000000000000001", 48, "B1ABC91C8604D55ABB61B7AA88749C29"},
+	{"0F62B5085BAE0154A7FA4DA0F34699EC", "288FF65DC42B92F9", 0, "613CB0BA96AFF6CACF2A459A102A7F78"},
+	{"0F62B5085BAE0154A7FA4DA0F34699EC", "288FF65DC42B92F9", 16, "CA985CF8FDD1474018758E36AE9923F5"},
+	{"0F62B5085BAE0154A7FA4DA0F34699EC", "288FF65DC42B92F9", 48, "B7EFA4C4C9C8D29DC5B3888314A6816F"},
+}
+
+func TestIVVectors(t *testing.T) {
+	for i, v := range ivVectors {
+		key, _ := hex.DecodeString(v.key)
+		iv, _ := hex.DecodeString(v.iv)
+		want, _ := hex.DecodeString(v.out)
+		c, err := NewCipherWithIV(key, iv)
+		if err != nil {
+			t.Fatalf("ivVectors [%d]: Failed to create cipher: %v", i, err)
+		}
+		c.SkipKeystream(v.offset)
+		if got := c.Keystream(16); !bytes.Equal(got, want) {
+			t.Errorf("ivVectors [%d]: out[%d:%d] = %X, want %X", i, v.offset, v.offset+16, got, want)
+		}
+	}
+}
+
+func TestRabbitCalcG(t *testing.T) {
+	for _, v := range []struct{ x, g uint32 }{
+		{0, 0},
+		{1, 1},
+		{0x10000, 1},
+		{0xFFFFFFFF, 0xFFFFFFFF},
+		{0x12345678, 0x1CBFBE9C},
+		{0x4D34D34D, 0xC0F8D72B},
+	} {
+		if g := rabbitCalcG(v.x); g != v.g {
+			t.Errorf("rabbitCalcG(%#x) = %#x, want %#x", v.x, g, v.g)
+		}
+	}
+	// The reference C code computes the high half of the square from
+	// 16-bit halves, relying on uint32 wraparound.
+	ref := func(x uint32) uint32 {
+		a, b := x&0xFFFF, x>>16
+		return ((((a*a)>>17+a*b)>>15)+b*b) ^ (x * x)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		x := rnd.Uint32()
+		if g, want := rabbitCalcG(x), ref(x); g != want {
+			t.Fatalf("rabbitCalcG(%#x) = %#x, want %#x", x, g, want)
+		}
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	r := testVectors[0]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 5))
+	if c.busy.Load() != 0 {
+		t.Fatalf("ProcessStream: busy flag left set")
+	}
+
+	for _, m := range []struct {
+		name string
+		f    func()
+	}{
+		{"ProcessStream", func() { c.ProcessStream(make([]byte, 5)) }},
+		{"ProcessSmall", func() { c.ProcessSmall(make([]byte, 5)) }},
+		{"ProcessByte", func() { c.ProcessByte(0) }},
+		{"NextBlock", func() { c.NextBlock() }},
+		{"GenerateKeystream", func() { c.GenerateKeystream(make([]byte, 32)) }},
+		{"SkipKeystream", func() { c.SkipKeystream(40) }},
+		{"Seek", func() { c.Seek(40) }},
+		{"Read", func() { c.Read(make([]byte, 5)) }},
+	} {
+		m.f()
+		if c.busy.Load() != 0 {
+			t.Fatalf("%s: busy flag left set", m.name)
+		}
+		c.busy.Store(1)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic while in use", m.name)
+				}
+			}()
+			m.f()
+		}()
+		c.busy.Store(0)
+	}
+
+	// A panic inside the guarded code releases the Cipher.
+	func() {
+		defer func() { recover() }()
+		c.xorKeyStream(make([]byte, 3), make([]byte, 40))
+	}()
+	if c.busy.Load() != 0 {
+		t.Fatalf("xorKeyStream: busy flag left set after a panic")
+	}
+	c.ProcessStream(make([]byte, 5))
+}
+
+func TestDeriveKey(t *testing.T) {
+	r := testVectors[3]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 7))
+	d := c.Clone()
+	k1 := c.DeriveKey([]byte("encryption"), 16)
+	k2 := c.DeriveKey([]byte("mac"), 32)
+	if bytes.Equal(k1, k2[:16]) {
+		t.Errorf("DeriveKey: same key for different contexts")
+	}
+	e, _ := NewCipher(r.key)
+	if k := e.DeriveKey([]byte("encryption"), 16); !bytes.Equal(k, k1) {
+		t.Errorf("DeriveKey: %X, want %X", k, k1)
+	}
+	if got, want := c.Keystream(64), d.Keystream(64); !bytes.Equal(got, want) {
+		t.Errorf("DeriveKey: changed the state of the cipher")
+	}
+}
+
+func TestVerifyPrefix(t *testing.T) {
+	r := testVectors[2]
+	enc, _ := NewCipherWithIV(r.key, r.iv)
+	dec, _ := NewCipherWithIV(r.key, r.iv)
+	msg := []byte("MAGIC header and the rest of the message")
+	ciphertext := make([]byte, len(msg))
+	enc.ProcessStreamTo(ciphertext, msg)
+	if !dec.VerifyPrefix(ciphertext, msg[:5]) {
+		t.Errorf("VerifyPrefix: rejected correct prefix")
+	}
+	if dec.VerifyPrefix(ciphertext, []byte("MAGIX")) {
+		t.Errorf("VerifyPrefix: accepted wrong prefix")
+	}
+	if dec.VerifyPrefix(ciphertext[:3], msg[:5]) {
+		t.Errorf("VerifyPrefix: accepted prefix longer than ciphertext")
+	}
+	other, _ := NewCipherWithIV(r.key, []byte("otherIV!"))
+	if other.VerifyPrefix(ciphertext, msg[:5]) {
+		t.Errorf("VerifyPrefix: accepted prefix under the wrong IV")
+	}
+	dec.ProcessStream(ciphertext)
+	if !bytes.Equal(ciphertext, msg) {
+		t.Errorf("VerifyPrefix: changed the state of the cipher")
+	}
+}
+
+func TestNextBlock(t *testing.T) {
+	r := testVectors[8]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := c.Keystream(64)
+	c.Seek(0)
+	for i := 0; i < 4; i++ {
+		if b := c.NextBlock(); !bytes.Equal(b[:], want[16*i:16*i+16]) {
+			t.Fatalf("NextBlock [%d] = %X, want %X", i, b, want[16*i:16*i+16])
+		}
+	}
+}
+
+func TestStringHidesState(t *testing.T) {
+	r := testVectors[9]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 5))
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		s := fmt.Sprintf(format, c)
+		for _, a := range []*[8]uint32{&c.x, &c.c, &c.cx, &c.cc} {
+			for _, w := range a {
+				for _, f := range []string{"%d", "%x", "%X"} {
+					if strings.Contains(s, fmt.Sprintf(f, w)) {
+						t.Fatalf("Sprintf(%q) = %q contains state word %#x", format, s, w)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestLongKeystream checks the SHA-256 hash of the first megabyte of key
+// stream against a C implementation, to catch counter or carry drift that
+// shows up only after many blocks.
+func TestLongKeystream(t *testing.T) {
+	key, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	iv, _ := hex.DecodeString("0001020304050607")
+	const want = "a277e9c0275375ed18388d940cea641da84e2569acb3189507426beff468ca8e"
+	c, _ := NewCipherWithIV(key, iv)
+	h := sha256.New()
+	buf := make([]byte, 1000)
+	for n := 1 << 20; n > 0; n -= len(buf) {
+		if n < len(buf) {
+			buf = buf[:n]
+		}
+		for i := range buf {
+			buf[i] = 0
+		}
+		c.ProcessStream(buf)
+		h.Write(buf)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("SHA-256 of 1MB key stream = %s, want %s", got, want)
+	}
+}
+
+func TestProcessStreams(t *testing.T) {
+	r := testVectors[10]
+	c1, _ := NewCipherWithIV(r.key, r.iv)
+	c2, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, 120)
+	c1.ProcessStream(want)
+	got := make([]byte, 120)
+	c2.ProcessStreams([][]byte{got[:1], got[1:1], got[1:17], got[17:50], nil, got[50:]})
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ProcessStreams: out = %X, want %X", got, want)
+	}
+}
+
+func TestBytesProcessed(t *testing.T) {
+	r := testVectors[11]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 5))
+	c.ProcessStreamTo(make([]byte, 20), make([]byte, 20))
+	c.Keystream(3)
+	c.SkipKeystream(40)
+	if n := c.BytesProcessed(); n != 68 {
+		t.Errorf("BytesProcessed = %d, want 68", n)
+	}
+	c.Seek(100)
+	if n := c.BytesProcessed(); n != 100 {
+		t.Errorf("BytesProcessed after Seek(100) = %d, want 100", n)
+	}
+	c.GenerateKeystream(make([]byte, 20))
+	c.NextBlock()
+	if n := c.BytesProcessed(); n != 148 {
+		t.Errorf("BytesProcessed = %d, want 148", n)
+	}
+	c.ResetCipher()
+	if n := c.BytesProcessed(); n != 0 {
+		t.Errorf("BytesProcessed after ResetCipher = %d, want 0", n)
+	}
+	c.Keystream(9)
+	c.SetupIV(r.iv)
+	if n := c.BytesProcessed(); n != 0 {
+		t.Errorf("BytesProcessed after SetupIV = %d, want 0", n)
+	}
+	c.Keystream(9)
+	c.Reset()
+	if n := c.BytesProcessed(); n != 0 {
+		t.Errorf("BytesProcessed after Reset = %d, want 0", n)
+	}
+}
+
+func TestRestoreIVState(t *testing.T) {
+	r := testVectors[7]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	want := c.Keystream(50)
+	for _, n := range []int{0, 5, 16, 33} {
+		c.ProcessStream(make([]byte, n))
+		c.RestoreIVState()
+		if got := c.Keystream(50); !bytes.Equal(got, want) {
+			t.Fatalf("RestoreIVState after %d bytes: out = %X, want %X", n, got, want)
+		}
+	}
+	c.RestoreIVState()
+	c.ProcessStream(make([]byte, 32))
+	c.SaveIVState()
+	c.ProcessStream(make([]byte, 7))
+	c.RestoreIVState()
+	if got := c.Keystream(18); !bytes.Equal(got, want[32:]) {
+		t.Fatalf("SaveIVState at 32: out = %X, want %X", got, want[32:])
+	}
+	c.Seek(2)
+	if got := c.Keystream(16); !bytes.Equal(got, want[34:]) {
+		t.Fatalf("SaveIVState at 32, Seek(2): out = %X, want %X", got, want[34:])
+	}
+}
+
+func TestProcessByte(t *testing.T) {
+	r := testVectors[9]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	want := make([]byte, 100)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	src := append([]byte(nil), want...)
+	d.ProcessStream(want)
+	got := make([]byte, 0, len(src))
+	for i := 0; i < len(src); {
+		if i%7 == 3 {
+			n := min(i%11+1, len(src)-i)
+			buf := append([]byte(nil), src[i:i+n]...)
+			c.ProcessStream(buf)
+			got = append(got, buf...)
+			i += n
+			continue
+		}
+		got = append(got, c.ProcessByte(src[i]))
+		i++
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ProcessByte: out = %X, want %X", got, want)
+	}
+	if c.BytesProcessed() != 100 {
+		t.Errorf("ProcessByte: BytesProcessed = %d, want 100", c.BytesProcessed())
+	}
+}
+
+func TestProcessStreamChecked(t *testing.T) {
+	r := testVectors[10]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	buf := make([]byte, 20)
+	if err := c.ProcessStreamChecked(buf); err != nil {
+		t.Fatalf("ProcessStreamChecked: %v", err)
+	}
+	if want := d.Keystream(20); !bytes.Equal(buf, want) {
+		t.Fatalf("ProcessStreamChecked: out = %X, want %X", buf, want)
+	}
+
+	// Pretend the stream is near its end; the counter itself is unaffected.
+	c.count = MaxStreamLength - 10
+	buf = make([]byte, 11)
+	if err := c.ProcessStreamChecked(buf); err != ErrStreamLimit {
+		t.Fatalf("ProcessStreamChecked past the limit: got error %v, want ErrStreamLimit", err)
+	}
+	if !bytes.Equal(buf, make([]byte, 11)) || c.count != MaxStreamLength-10 {
+		t.Fatalf("ProcessStreamChecked past the limit: changed buf or count")
+	}
+	if err := c.ProcessStreamChecked(buf[:10]); err != nil {
+		t.Fatalf("ProcessStreamChecked up to the limit: %v", err)
+	}
+	if want := d.Keystream(10); !bytes.Equal(buf[:10], want) {
+		t.Fatalf("ProcessStreamChecked up to the limit: out = %X, want %X", buf[:10], want)
+	}
+	if c.BytesProcessed() != MaxStreamLength {
+		t.Fatalf("BytesProcessed = %d, want MaxStreamLength", c.BytesProcessed())
+	}
+	if err := c.ProcessStreamChecked(buf[:1]); err != ErrStreamLimit {
+		t.Fatalf("ProcessStreamChecked at the limit: got error %v, want ErrStreamLimit", err)
+	}
+	if err := c.ProcessStreamChecked(nil); err != nil {
+		t.Fatalf("ProcessStreamChecked(nil) at the limit: %v", err)
+	}
+	c.SetupIV(r.iv)
+	if err := c.ProcessStreamChecked(buf); err != nil {
+		t.Fatalf("ProcessStreamChecked after SetupIV: %v", err)
+	}
+}
+
+func TestNewCipherStrict(t *testing.T) {
+	key, iv := make([]byte, KeySize), make([]byte, IVSize)
+	if _, err := NewCipherStrict(key, []byte("ivivivi!")); err != ErrZeroKey {
+		t.Errorf("NewCipherStrict with zero key: got error %v, want ErrZeroKey", err)
+	}
+	key[15] = 1
+	if _, err := NewCipherStrict(key, iv); err != ErrZeroIV {
+		t.Errorf("NewCipherStrict with zero iv: got error %v, want ErrZeroIV", err)
+	}
+	if _, err := NewCipherStrict(key, nil); err != IVSizeError(0) {
+		t.Errorf("NewCipherStrict with empty iv: got error %v, want IVSizeError(0)", err)
+	}
+	if _, err := NewCipherStrict(key[:3], iv); err != KeySizeError(3) {
+		t.Errorf("NewCipherStrict: got error %v, want KeySizeError(3)", err)
+	}
+	iv[0] = 1
+	c, err := NewCipherStrict(key, iv)
+	if err != nil {
+		t.Fatalf("NewCipherStrict: %v", err)
+	}
+	d, _ := NewCipherWithIV(key, iv)
+	if got, want := c.Keystream(32), d.Keystream(32); !bytes.Equal(got, want) {
+		t.Fatalf("NewCipherStrict: out = %X, want %X", got, want)
+	}
+	if _, err := NewCipherWithIV(make([]byte, KeySize), make([]byte, IVSize)); err != nil {
+		t.Errorf("NewCipherWithIV with zero key and iv: %v", err)
+	}
+}
+
+func TestSamePosition(t *testing.T) {
+	r := testVectors[11]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	if !c.SamePosition(d) {
+		t.Fatalf("SamePosition: new ciphers not at the same position")
+	}
+	for _, n := range []int{1, 15, 16, 5} {
+		c.ProcessStream(make([]byte, n))
+		if c.SamePosition(d) {
+			t.Fatalf("SamePosition: true with one cipher %d bytes ahead", n)
+		}
+		d.ProcessStream(make([]byte, n))
+		if !c.SamePosition(d) || !d.SamePosition(c) {
+			t.Fatalf("SamePosition: false after both processed %d bytes", n)
+		}
+	}
+	e, _ := NewCipherWithIV(r.key, []byte("other iv"))
+	e.Seek(37)
+	if c.SamePosition(e) {
+		t.Fatalf("SamePosition: true for different IVs")
+	}
+	d.ProcessStream(make([]byte, 16))
+	c.Seek(53)
+	if !c.SamePosition(d) {
+		t.Fatalf("SamePosition: false after Seek to the same offset")
+	}
+}
+
+func TestNewCipherAt(t *testing.T) {
+	r := testVectors[12]
+	src := make([]byte, 1000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	want := append([]byte(nil), src...)
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(want)
+	got := append([]byte(nil), src...)
+	bounds := []int{0, 1, 17, 32, 500, 999, 1000}
+	for i := 0; i+1 < len(bounds); i++ {
+		w, err := NewCipherAt(r.key, r.iv, uint64(bounds[i]))
+		if err != nil {
+			t.Fatalf("NewCipherAt: %v", err)
+		}
+		w.ProcessStream(got[bounds[i]:bounds[i+1]])
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("NewCipherAt: concatenated ranges differ from a single pass")
+	}
+	if _, err := NewCipherAt(r.key, r.iv[:3], 5); err != IVSizeError(3) {
+		t.Errorf("NewCipherAt: got error %v, want IVSizeError(3)", err)
+	}
+}
+
+func TestTailLengths(t *testing.T) {
+	r := testVectors[13]
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	want := d.Keystream(128)
+	for _, blocks := range []int{0, 1, 2} {
+		for n := 1; n <= 15; n++ {
+			c, _ := NewCipherWithIV(r.key, r.iv)
+			l := 16*blocks + n
+			got := make([]byte, l)
+			c.ProcessStream(got)
+			if !bytes.Equal(got, want[:l]) {
+				t.Fatalf("tail of %d after %d blocks: out = %X, want %X", n, blocks, got, want[:l])
+			}
+			if c.rn != 16-n {
+				t.Fatalf("tail of %d after %d blocks: %d bytes buffered, want %d", n, blocks, c.rn, 16-n)
+			}
+			if rest := c.r[16-c.rn:]; !bytes.Equal(rest, want[l:16*blocks+16]) {
+				t.Fatalf("tail of %d after %d blocks: buffered %X, want %X", n, blocks, rest, want[l:16*blocks+16])
+			}
+			// Continue with lengths that stop inside, at the end of and past
+			// the buffered block.
+			for _, m := range []int{1, 16 - n, 17} {
+				e := c.Clone()
+				got := make([]byte, m)
+				e.ProcessStream(got)
+				if !bytes.Equal(got, want[l:l+m]) {
+					t.Fatalf("tail of %d after %d blocks, then %d: out = %X, want %X", n, blocks, m, got, want[l:l+m])
+				}
+			}
+		}
+	}
+}
+
+func TestProcessStreamWipe(t *testing.T) {
+	r := testVectors[14]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	want := []byte("sensitive plaintext")
+	buf := append([]byte(nil), want...)
+	d.ProcessStream(buf)
+	func() {
+		defer c.ProcessStreamWipe(buf)()
+		if !bytes.Equal(buf, want) {
+			t.Fatalf("ProcessStreamWipe: out = %q, want %q", buf, want)
+		}
+	}()
+	if !bytes.Equal(buf, make([]byte, len(want))) {
+		t.Fatalf("ProcessStreamWipe: buffer not zeroed: %q", buf)
+	}
+}
+
+func TestUnkeyedCipher(t *testing.T) {
+	r := testVectors[15]
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if e := recover(); e == nil {
+				t.Errorf("%s on unkeyed Cipher did not panic", name)
+			} else if !strings.Contains(fmt.Sprint(e), "without a key") {
+				t.Errorf("%s on unkeyed Cipher: panic %v", name, e)
+			}
+		}()
+		f()
+	}
+	var c Cipher
+	if err := c.SetupIV(r.iv); err != ErrNoKey {
+		t.Errorf("SetupIV on zero Cipher: got error %v, want ErrNoKey", err)
+	}
+	if err := c.SetupIV(nil); err != ErrNoKey {
+		t.Errorf("SetupIV(nil) on zero Cipher: got error %v, want ErrNoKey", err)
+	}
+	mustPanic("ProcessStream", func() { c.ProcessStream(make([]byte, 5)) })
+	mustPanic("ProcessByte", func() { c.ProcessByte(0) })
+	mustPanic("NextBlock", func() { c.NextBlock() })
+	mustPanic("GenerateKeystream", func() { c.GenerateKeystream(make([]byte, 16)) })
+
+	if err := c.SetKey(r.key); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+	if err := c.SetupIV(r.iv); err != nil {
+		t.Fatalf("SetupIV after SetKey: %v", err)
+	}
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	if got, want := c.Keystream(20), d.Keystream(20); !bytes.Equal(got, want) {
+		t.Fatalf("zero Cipher after SetKey: out = %X, want %X", got, want)
+	}
+	if e := d.Clone(); !e.keyed {
+		t.Errorf("Clone: copy has no key")
+	}
+	d.Reset()
+	mustPanic("ProcessStream after Reset", func() { d.ProcessStream(make([]byte, 5)) })
+	if err := d.SetupIV(r.iv); err != ErrNoKey {
+		t.Errorf("SetupIV after Reset: got error %v, want ErrNoKey", err)
+	}
+}
+
+func TestSetCounter(t *testing.T) {
+	r := testVectors[16]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 21))
+	ctr, carry := c.Counter()
+	if ctr != c.c || carry != (c.carry == 1) {
+		t.Fatalf("Counter = %#x, %v, want %#x, %v", ctr, carry, c.c, c.carry == 1)
+	}
+	d := c.Clone()
+	c.SetCounter([8]uint32{}, !carry)
+	c.SetCounter(ctr, carry)
+	if !c.SamePosition(d) {
+		t.Fatalf("SetCounter: round trip changed the position")
+	}
+	if got, want := c.Keystream(50), d.Keystream(50); !bytes.Equal(got, want) {
+		t.Fatalf("SetCounter: out = %X, want %X", got, want)
+	}
+	// A counter from another position does not match the internal state.
+	e, _ := NewCipherWithIV(r.key, r.iv)
+	e.SetCounter(d.Counter())
+	if e.SamePosition(d) {
+		t.Fatalf("SetCounter: counter alone moved the cipher to another position")
+	}
+}
+
+func TestProcessStreamCRC(t *testing.T) {
+	r := testVectors[17]
+	for _, n := range []int{0, 1, 4095, 4096, 10000} {
+		plain := make([]byte, n)
+		for i := range plain {
+			plain[i] = byte(i * 11)
+		}
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		d, _ := NewCipherWithIV(r.key, r.iv)
+		buf := append([]byte(nil), plain...)
+		if got, want := c.ProcessStreamCRC(buf), crc32.ChecksumIEEE(buf); got != want {
+			t.Fatalf("ProcessStreamCRC(%d) encrypting = %#x, want CRC of ciphertext %#x", n, got, want)
+		}
+		want := append([]byte(nil), plain...)
+		d.ProcessStream(want)
+		if !bytes.Equal(buf, want) {
+			t.Fatalf("ProcessStreamCRC(%d): out differs from ProcessStream", n)
+		}
+		e, _ := NewCipherWithIV(r.key, r.iv)
+		if got, want := e.ProcessStreamCRC(buf), crc32.ChecksumIEEE(plain); got != want {
+			t.Fatalf("ProcessStreamCRC(%d) decrypting = %#x, want CRC of plaintext %#x", n, got, want)
+		}
+		if !bytes.Equal(buf, plain) {
+			t.Fatalf("ProcessStreamCRC(%d): round trip mismatch", n)
+		}
+	}
+}
+
+func TestProcessSmall(t *testing.T) {
+	r := testVectors[18]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	var got, want []byte
+	for i := 0; i < 200; i++ {
+		n := i * 7 % 17
+		buf := make([]byte, n)
+		for j := range buf {
+			buf[j] = byte(i + j)
+		}
+		w := append([]byte(nil), buf...)
+		c.ProcessSmall(buf)
+		d.ProcessStream(w)
+		got, want = append(got, buf...), append(want, w...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ProcessSmall: out differs from ProcessStream")
+	}
+	if !c.SamePosition(d) || c.BytesProcessed() != d.BytesProcessed() {
+		t.Fatalf("ProcessSmall: final state differs from ProcessStream")
+	}
+	buf := make([]byte, 16)
+	if n := testing.AllocsPerRun(100, func() { c.ProcessSmall(buf[:5]); c.ProcessSmall(buf) }); n != 0 {
+		t.Errorf("ProcessSmall: %v allocations, want 0", n)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("ProcessSmall of 17 bytes did not panic")
+		}
+	}()
+	c.ProcessSmall(make([]byte, 17))
+}
+
+func BenchmarkProcessSmall(b *testing.B) {
+	for _, n := range []int{1, 7, 15, 16} {
+		buf := make([]byte, n)
+		b.Run(fmt.Sprintf("ProcessSmall/%d", n), func(b *testing.B) {
+			c, _ := NewCipherWithIV(make([]byte, 16), make([]byte, 8))
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				c.ProcessSmall(buf)
+			}
+		})
+		b.Run(fmt.Sprintf("ProcessStream/%d", n), func(b *testing.B) {
+			c, _ := NewCipherWithIV(make([]byte, 16), make([]byte, 8))
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				c.ProcessStream(buf)
+			}
+		})
+	}
+}
+
+func TestNewCipherRounds(t *testing.T) {
+	for i := 0; i < len(testVectors); i += 7 {
+		r := testVectors[i]
+		c, err := NewCipherRounds(r.key, 4)
+		if err != nil {
+			t.Fatalf("testVectors [%d]: NewCipherRounds: %v", i, err)
+		}
+		d, _ := NewCipher(r.key)
+		if StateOf(c) != StateOf(d) {
+			t.Fatalf("testVectors [%d]: NewCipherRounds(key, 4) state differs from NewCipher", i)
+		}
+		c.SetupIV(r.iv)
+		d.SetupIV(r.iv)
+		if got, want := c.Keystream(r.zero), d.Keystream(r.zero); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: NewCipherRounds(key, 4): key stream differs from NewCipher", i)
+		}
+	}
+	r := testVectors[0]
+	d, _ := NewCipher(r.key)
+	want := d.Keystream(32)
+	c5, _ := NewCipherRounds(r.key, 5)
+	c6, _ := NewCipherRounds(r.key, 6)
+	k5, k6 := c5.Keystream(32), c6.Keystream(32)
+	if bytes.Equal(k5, want) || bytes.Equal(k6, want) || bytes.Equal(k5, k6) {
+		t.Fatalf("NewCipherRounds: extra rounds do not change the key stream")
+	}
+	c0, err := NewCipherRounds(r.key, 0)
+	if err != nil || !bytes.Equal(c0.Keystream(32), want) {
+		t.Fatalf("NewCipherRounds(key, 0): got error %v or a non-standard key stream", err)
+	}
+	for _, n := range []int{-1, 3} {
+		if _, err := NewCipherRounds(r.key, n); err != errRounds {
+			t.Errorf("NewCipherRounds(key, %d): got error %v, want %v", n, err, errRounds)
+		}
+	}
+	if _, err := NewCipherRounds(r.key[:4], 8); err != KeySizeError(4) {
+		t.Errorf("NewCipherRounds: got error %v, want KeySizeError(4)", err)
+	}
+}
+
+func TestNewCipherDeterministic(t *testing.T) {
+	for i, r := range testVectors {
+		key := append([]byte(nil), r.key...)
+		a, _ := NewCipher(key)
+		b, _ := NewCipher(r.key)
+		for j := range key {
+			key[j] = 0
+		}
+		if StateOf(a) != StateOf(b) {
+			t.Fatalf("testVectors [%d]: ciphers from the same key have different states", i)
+		}
+		if r.iv != nil {
+			a.SetupIV(r.iv)
+			b.SetupIV(r.iv)
+		}
+		if got, want := a.Keystream(r.zero), b.Keystream(r.zero); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: ciphers from the same key produce different key streams", i)
+		}
+	}
+}
+
+func TestKeyNotRetained(t *testing.T) {
+	for i := 0; i < len(testVectors); i += 5 {
+		r := testVectors[i]
+		iv := r.iv
+		if iv == nil {
+			iv = make([]byte, IVSize)
+		}
+		want, _ := NewCipherWithIV(r.key, iv)
+
+		key := append([]byte(nil), r.key...)
+		ivc := append([]byte(nil), iv...)
+		c, _ := NewCipherWithIV(key, ivc)
+		for j := range key {
+			key[j] ^= 0xFF
+		}
+		for j := range ivc {
+			ivc[j] ^= 0xFF
+		}
+		if got, want := c.Keystream(r.zero), want.Keystream(r.zero); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: key stream changed after mutating the key and iv slices", i)
+		}
+
+		// The saved key-only state must not depend on the slices either.
+		copy(ivc, iv)
+		d, _ := NewCipher(append([]byte(nil), r.key...))
+		d.SetupIV(ivc)
+		for j := range ivc {
+			ivc[j] = 0
+		}
+		d.ResetCipher()
+		d.SetupIV(iv)
+		c.SetupIV(iv)
+		if got, want := d.Keystream(r.zero), c.Keystream(r.zero); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: key stream changed after mutating the iv slice", i)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	for i, r := range testVectors {
+		if r.iv == nil {
+			continue
+		}
+		data := make([]byte, r.zero)
+		for j := range data {
+			data[j] = byte(j * 3)
+		}
+		orig := append([]byte(nil), data...)
+		ct, err := Encrypt(r.key, r.iv, data)
+		if err != nil {
+			t.Fatalf("testVectors [%d]: Encrypt: %v", i, err)
+		}
+		if !bytes.Equal(data, orig) {
+			t.Fatalf("testVectors [%d]: Encrypt modified its input", i)
+		}
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		want := append([]byte(nil), data...)
+		c.ProcessStream(want)
+		if !bytes.Equal(ct, want) {
+			t.Fatalf("testVectors [%d]: Encrypt:\ngot  %x\nwant %x", i, ct, want)
+		}
+		pt, err := Decrypt(r.key, r.iv, ct)
+		if err != nil {
+			t.Fatalf("testVectors [%d]: Decrypt: %v", i, err)
+		}
+		if !bytes.Equal(pt, data) {
+			t.Fatalf("testVectors [%d]: Decrypt: round trip mismatch", i)
+		}
+	}
+	r := testVectors[0]
+	if _, err := Encrypt(r.key[:8], r.iv, nil); err != KeySizeError(8) {
+		t.Errorf("Encrypt: got error %v, want KeySizeError(8)", err)
+	}
+	if _, err := Decrypt(r.key, make([]byte, 4), nil); err != IVSizeError(4) {
+		t.Errorf("Decrypt: got error %v, want IVSizeError(4)", err)
+	}
+	for _, iv := range [][]byte{nil, {}} {
+		if _, err := Encrypt(r.key, iv, []byte("data")); err != IVSizeError(0) {
+			t.Errorf("Encrypt with an empty iv: got error %v, want IVSizeError(0)", err)
+		}
+		if _, err := Decrypt(r.key, iv, []byte("data")); err != IVSizeError(0) {
+			t.Errorf("Decrypt with an empty iv: got error %v, want IVSizeError(0)", err)
+		}
+	}
+	if out, err := Encrypt(r.key, r.iv, nil); err != nil || out == nil || len(out) != 0 {
+		t.Errorf("Encrypt(nil): got %v, %v, want empty slice", out, err)
+	}
+}
+
+func TestProcessStreamEmpty(t *testing.T) {
+	r := testVectors[1]
+	for _, n := range []int{0, 32, 17, 21, 31} {
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		c.ProcessStream(make([]byte, n))
+		want := StateOf(c)
+		c.ProcessStream(nil)
+		c.ProcessStream([]byte{})
+		c.ProcessStreams(nil)
+		c.ProcessStreams([][]byte{nil, {}})
+		c.XORKeyStream(nil, nil)
+		c.ProcessSmall(nil)
+		if got := StateOf(c); got != want {
+			t.Fatalf("after %d bytes: empty calls changed the state", n)
+		}
+		d, _ := NewCipherWithIV(r.key, r.iv)
+		d.ProcessStream(make([]byte, n))
+		if got, want := c.Keystream(40), d.Keystream(40); !bytes.Equal(got, want) {
+			t.Fatalf("after %d bytes: key stream changed after empty calls", n)
+		}
+	}
+}
+
+func TestPositionToken(t *testing.T) {
+	for i := 0; i < len(testVectors); i += 4 {
+		r := testVectors[i]
+		c1, _ := NewCipherWithIV(r.key, r.iv)
+		c1.ProcessStream(make([]byte, 16*i+i%16))
+		token := c1.PositionToken()
+		if want := positionSize + c1.rn; len(token) != want {
+			t.Fatalf("testVectors [%d]: PositionToken: got %d bytes, want %d", i, len(token), want)
+		}
+
+		c2, _ := NewCipher(r.key)
+		if err := c2.RestorePosition(token); err != nil {
+			t.Fatalf("testVectors [%d]: RestorePosition: %v", i, err)
+		}
+		if c2.BytesProcessed() != c1.BytesProcessed() {
+			t.Fatalf("testVectors [%d]: RestorePosition: BytesProcessed got %d, want %d", i, c2.BytesProcessed(), c1.BytesProcessed())
+		}
+		if got, want := c2.Keystream(100), c1.Keystream(100); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: RestorePosition: key stream mismatch", i)
+		}
+
+		// The saved key-only state is kept.
+		d, _ := NewCipher(r.key)
+		c2.ResetCipher()
+		if got, want := c2.Keystream(32), d.Keystream(32); !bytes.Equal(got, want) {
+			t.Fatalf("testVectors [%d]: ResetCipher after RestorePosition: key stream mismatch", i)
+		}
+	}
+
+	r := testVectors[0]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	c.ProcessStream(make([]byte, 5))
+	token := c.PositionToken()
+	d, _ := NewCipher(r.key)
+	want := StateOf(d)
+	for _, bad := range [][]byte{
+		nil,
+		token[:positionSize-1],
+		token[:len(token)-1],
+		append(append([]byte(nil), token...), 0),
+		append([]byte{2}, token[1:]...),
+	} {
+		if err := d.RestorePosition(bad); err != errPositionToken {
+			t.Fatalf("RestorePosition(%x): got error %v, want %v", bad, err, errPositionToken)
+		}
+		if StateOf(d) != want {
+			t.Fatalf("RestorePosition(%x): state changed on error", bad)
+		}
+	}
+	var u Cipher
+	if err := u.RestorePosition(token); err != ErrNoKey {
+		t.Fatalf("RestorePosition on unkeyed Cipher: got error %v, want ErrNoKey", err)
+	}
+}
+
+func TestKeystreamHex(t *testing.T) {
+	// testVectors [0], from the eSTREAM set, key 80000000...00 and iv 0.
+	c, _ := NewCipherWithIV(testVectors[0].key, testVectors[0].iv)
+	if got, want := c.KeystreamHex(16), "dcdcb614f738a20ce103637e58091766"; got != want {
+		t.Errorf("KeystreamHex: got %s, want %s", got, want)
+	}
+	if got, want := c.BytesProcessed(), uint64(16); got != want {
+		t.Errorf("KeystreamHex: BytesProcessed got %d, want %d", got, want)
+	}
+
+	// The first block of RFC 4503's all-zero key vector, byte-reversed.
+	v := specVectors[0]
+	c, _ = NewCipher(specBytes(v.key))
+	if got, want := c.KeystreamHex(16), hex.EncodeToString(specBytes(v.out[0])); got != want {
+		t.Errorf("KeystreamHex: got %s, want %s", got, want)
+	}
+	if got := c.KeystreamHex(0); got != "" {
+		t.Errorf("KeystreamHex(0): got %q, want empty", got)
+	}
+}
+
+func TestNewCipherTrackIVs(t *testing.T) {
+	r := testVectors[3]
+	c, err := NewCipherTrackIVs(r.key)
+	if err != nil {
+		t.Fatalf("NewCipherTrackIVs: %v", err)
+	}
+	iv1 := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	iv2 := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	if err := c.SetupIV(iv1); err != nil {
+		t.Fatalf("SetupIV: %v", err)
+	}
+	if err := c.SetupIV(iv2); err != nil {
+		t.Fatalf("SetupIV: %v", err)
+	}
+	c.ProcessStream(make([]byte, 21))
+	want := StateOf(c)
+	if err := c.SetupIV(append([]byte(nil), iv1...)); err != ErrIVReuse {
+		t.Fatalf("SetupIV with a repeated iv: got error %v, want ErrIVReuse", err)
+	}
+	if StateOf(c) != want {
+		t.Fatalf("SetupIV with a repeated iv: state changed")
+	}
+	// An empty iv is not tracked.
+	if err := c.SetupIV(nil); err != nil {
+		t.Fatalf("SetupIV(nil): %v", err)
+	}
+	if err := c.SetupIV(nil); err != nil {
+		t.Fatalf("SetupIV(nil): %v", err)
+	}
+
+	// The clone has a copy of the set.
+	d := c.Clone()
+	if err := d.SetupIV(iv2); err != ErrIVReuse {
+		t.Fatalf("Clone: SetupIV with a repeated iv: got error %v, want ErrIVReuse", err)
+	}
+	iv3 := []byte{3, 3, 3, 3, 3, 3, 3, 3}
+	d.SetupIV(iv3)
+	if err := c.SetupIV(iv3); err != nil {
+		t.Fatalf("SetupIV after use on a clone: %v", err)
+	}
+
+	// A new key forgets the IVs.
+	c.SetKey(r.key)
+	if err := c.SetupIV(iv1); err != nil {
+		t.Fatalf("SetupIV after SetKey: %v", err)
+	}
+	c.Reset()
+	c.SetKey(r.key)
+	if err := c.SetupIV(iv1); err != nil {
+		t.Fatalf("SetupIV after Reset: %v", err)
+	}
+
+	if err := c.SetupIVUint64(7); err != nil {
+		t.Fatalf("SetupIVUint64: %v", err)
+	}
+	if err := c.SetupIVUint64(7); err != ErrIVReuse {
+		t.Fatalf("SetupIVUint64 with a repeated counter: got error %v, want ErrIVReuse", err)
+	}
+	var u0 Cipher
+	if err := u0.SetupIVUint64(7); err != ErrNoKey {
+		t.Fatalf("SetupIVUint64 on an unkeyed Cipher: got error %v, want ErrNoKey", err)
+	}
+
+	// Tracking does not change the key stream, and DeriveKey, which sets
+	// up an IV on a copy, is unaffected by the set.
+	u, _ := NewCipherWithIV(r.key, iv2)
+	e, _ := NewCipherTrackIVs(r.key)
+	e.SetupIV(iv2)
+	if got, want := e.Keystream(r.zero), u.Keystream(r.zero); !bytes.Equal(got, want) {
+		t.Fatalf("NewCipherTrackIVs: key stream differs from NewCipherWithIV")
+	}
+	k1 := e.DeriveKey([]byte("ctx"), 16)
+	if k2 := e.DeriveKey([]byte("ctx"), 16); !bytes.Equal(k1, k2) {
+		t.Fatalf("DeriveKey on a tracking Cipher: results differ")
+	}
+
+	// Ciphers without tracking accept any IV again.
+	u.SetupIV(iv2)
+	if err := u.SetupIV(iv2); err != nil {
+		t.Fatalf("SetupIV without tracking: %v", err)
+	}
+}
+
+func TestPeekKeystream(t *testing.T) {
+	for i := 0; i < len(testVectors); i += 6 {
+		r := testVectors[i]
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		c.ProcessStream(make([]byte, i))
+		want := StateOf(c)
+		peek := c.PeekKeystream(37)
+		if StateOf(c) != want {
+			t.Fatalf("testVectors [%d]: PeekKeystream changed the state", i)
+		}
+		if again := c.PeekKeystream(37); !bytes.Equal(again, peek) {
+			t.Fatalf("testVectors [%d]: PeekKeystream: repeated peek differs", i)
+		}
+		data := make([]byte, 37)
+		for j := range data {
+			data[j] = byte(j * 11)
+		}
+		buf := append([]byte(nil), data...)
+		c.ProcessStream(buf[:5])
+		c.ProcessStream(buf[5:])
+		for j := range buf {
+			if buf[j] != data[j]^peek[j] {
+				t.Fatalf("testVectors [%d]: PeekKeystream: byte %d: got %#x, want %#x", i, j, buf[j], data[j]^peek[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import "encoding/binary"
+
+// A Source is a math/rand.Source64 producing values from the key stream of
+// a Cipher. For a given key and seed its output is always the same.
+type Source struct {
+	c *Cipher
+}
+
+// NewSource returns a Source drawing from c. The Source shares c, so its
+// output continues c's key stream and Seed sets up a new IV on c.
+func NewSource(c *Cipher) *Source {
+	return &Source{c}
+}
+
+// Seed will setup the Initialization vector given by the 8-byte
+// little-endian encoding of seed, restarting the key stream. The
+// math/rand.Source interface leaves Seed no way to return an error, so it
+// panics with the error of SetupIVUint64: if c has no key, or if c is from
+// NewCipherTrackIVs and seed was already used.
+func (s *Source) Seed(seed int64) {
+	if err := s.c.SetupIVUint64(uint64(seed)); err != nil {
+		panic(err)
+	}
+}
+
+// Uint64 returns the next 8 bytes of key stream as a little-endian uint64.
+func (s *Source) Uint64() uint64 {
+	var b [8]byte
+	s.c.xorKeyStream(b[:], b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// Int63 returns a non-negative pseudo-random 63-bit integer.
+func (s *Source) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Shuffle pseudo-randomizes the order of elements with a Fisher-Yates
+// shuffle driven by the key stream, with the same signature as
+// math/rand.Shuffle. n is the number of elements and swap swaps the
+// elements with indexes i and j. Shuffle panics if n < 0.
+func (s *Source) Shuffle(n int, swap func(i, j int)) {
+	if n < 0 {
+		panic("crypto/rabbit: invalid argument to Shuffle")
+	}
+	for i := n - 1; i > 0; i-- {
+		j := int(s.uint64n(uint64(i) + 1))
+		swap(i, j)
+	}
+}
+
+// uint64n returns a uniform value in [0, n), n > 0. Words below 2^64 mod n
+// are rejected so that the remaining range is a whole multiple of n and
+// the result is unbiased.
+func (s *Source) uint64n(n uint64) uint64 {
+	lo := -n % n
+	for {
+		if v := s.Uint64(); v >= lo {
+			return v % n
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var _ rand.Source64 = (*Source)(nil)
+
+func TestSource(t *testing.T) {
+	key := testVectors[0].key
+	c, _ := NewCipher(key)
+	s := NewSource(c)
+	s.Seed(42)
+	d, _ := NewCipher(key)
+	d.SetupIVUint64(42)
+	ks := d.Keystream(80)
+	for i := 0; i < 5; i++ {
+		if got, want := s.Uint64(), binary.LittleEndian.Uint64(ks[16*i:]); got != want {
+			t.Fatalf("Uint64 [%d] = %#x, want %#x", i, got, want)
+		}
+		if got, want := s.Int63(), int64(binary.LittleEndian.Uint64(ks[16*i+8:])>>1); got != want {
+			t.Fatalf("Int63 [%d] = %#x, want %#x", i, got, want)
+		}
+	}
+	r1 := rand.New(NewSource(c))
+	r1.Seed(7)
+	a := r1.Perm(20)
+	r1.Seed(7)
+	b := r1.Perm(20)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Perm after Seed(7) differs: %v, %v", a, b)
+		}
+	}
+}
+
+func TestSourceSeedError(t *testing.T) {
+	c, _ := NewCipherTrackIVs(testVectors[0].key)
+	s := NewSource(c)
+	s.Seed(1)
+	defer func() {
+		if err := recover(); err != ErrIVReuse {
+			t.Errorf("Seed with a repeated seed: got panic %v, want ErrIVReuse", err)
+		}
+	}()
+	s.Seed(1)
+}
+
+func TestShuffle(t *testing.T) {
+	key := testVectors[1].key
+	c, _ := NewCipher(key)
+	s := NewSource(c)
+	perm := func(seed int64) []int {
+		s.Seed(seed)
+		p := make([]int, 50)
+		for i := range p {
+			p[i] = i
+		}
+		s.Shuffle(len(p), func(i, j int) { p[i], p[j] = p[j], p[i] })
+		return p
+	}
+	a, b := perm(3), perm(3)
+	seen := make([]bool, len(a))
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Shuffle after Seed(3) differs: %v, %v", a, b)
+		}
+		if seen[a[i]] {
+			t.Fatalf("Shuffle: %v is not a permutation", a)
+		}
+		seen[a[i]] = true
+	}
+	if c := perm(4); fmt.Sprint(c) == fmt.Sprint(a) {
+		t.Errorf("Shuffle: Seed(3) and Seed(4) give the same order %v", a)
+	}
+
+	// Each of the 6 orders of 3 elements should be about equally likely.
+	counts := make(map[[3]int]int)
+	s.Seed(5)
+	for i := 0; i < 6000; i++ {
+		p := [3]int{0, 1, 2}
+		s.Shuffle(3, func(i, j int) { p[i], p[j] = p[j], p[i] })
+		counts[p]++
+	}
+	if len(counts) != 6 {
+		t.Fatalf("Shuffle(3): %d distinct orders, want 6", len(counts))
+	}
+	for p, n := range counts {
+		if n < 850 || n > 1150 {
+			t.Errorf("Shuffle(3): order %v seen %d times in 6000, want about 1000", p, n)
+		}
+	}
+	s.Shuffle(0, func(i, j int) { t.Fatalf("Shuffle(0) called swap") })
+	s.Shuffle(1, func(i, j int) { t.Fatalf("Shuffle(1) called swap") })
+}
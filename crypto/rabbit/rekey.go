@@ -0,0 +1,125 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"encoding/binary"
+	"runtime"
+)
+
+// Ratchet replaces the key with the next KeySize bytes of key stream and
+// runs the key setup with it, leaving c as NewCipher would for the new key:
+// no IV and nothing pending. A Cipher from NewCipherRounds keeps its number
+// of key setup rounds. Two endpoints ratcheting at the same stream
+// position, for example after every message, stay in lockstep.
+//
+// Ratchet gives forward secrecy: the new state is derived from the old one
+// by a one-way step and the old state is overwritten, so a Cipher
+// compromised after Ratchet does not reveal any key stream from before it.
+// The reverse does not hold, as anyone holding the old state can compute
+// every later key. Clones and marshaled states taken before Ratchet keep
+// the old key, and must be destroyed too for the property to hold.
+func (c *Cipher) Ratchet() {
+	var k [KeySize]byte
+	c.xorKeyStream(k[:], k[:])
+	c.setKey(k[:], c.keyRounds())
+	clear(k[:])
+	runtime.KeepAlive(&k)
+}
+
+// A RekeyingStream is a crypto/cipher.Stream that limits how much key
+// stream is produced under any one IV. The stream is identified by an 8-byte
+// IV, iv; epoch e uses the IV iv XOR the 8-byte little-endian encoding of e,
+// and after every limit bytes the stream moves on to the next epoch. Streams
+// under one key must have distinct ivs, and two ivs whose XOR is smaller than
+// the number of epochs used share an epoch IV, so random ivs, or ivs that
+// differ in their high bytes, are best.
+//
+// No re-sync marker is inserted: XORKeyStream must keep the length of the
+// data to be a cipher.Stream, and the schedule depends only on the byte
+// position, so the decrypting side mirrors it by using a RekeyingStream with
+// the same key, iv and limit, and after lost or skipped data re-syncs with
+// Seek to the byte offset known from the framing of its transport. Epoch
+// tells protocols that record re-sync points where the stream is.
+type RekeyingStream struct {
+	c     *Cipher
+	iv    [IVSize]byte
+	limit uint64
+	left  uint64
+	epoch uint64
+}
+
+// NewRekeyingStream returns a RekeyingStream using c for the stream
+// identified by iv, with c set up for epoch 0 right away. It panics if limit
+// is zero. iv must be IVSize (8) bytes long; otherwise NewRekeyingStream
+// returns an IVSizeError.
+func NewRekeyingStream(c *Cipher, iv []byte, limit uint64) (*RekeyingStream, error) {
+	if limit == 0 {
+		panic("crypto/rabbit: zero rekey limit")
+	}
+	if k := len(iv); !ValidIVSize(k) {
+		return nil, IVSizeError(k)
+	}
+	s := &RekeyingStream{c: c, iv: [IVSize]byte(iv), limit: limit, left: limit}
+	if err := s.setupEpoch(0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setupEpoch sets up the IV for epoch e.
+func (s *RekeyingStream) setupEpoch(e uint64) error {
+	var iv [IVSize]byte
+	binary.LittleEndian.PutUint64(iv[:], binary.LittleEndian.Uint64(s.iv[:])^e)
+	if err := s.c.SetupIV(iv[:]); err != nil {
+		return err
+	}
+	s.epoch, s.left = e, s.limit
+	return nil
+}
+
+// Epoch returns the number of rekeys done so far, which is also the
+// counter the current IV was derived from.
+func (s *RekeyingStream) Epoch() uint64 {
+	return s.epoch
+}
+
+// Seek moves the stream to offset bytes from its start, setting up the IV
+// of the epoch that offset falls in. On a Cipher from NewCipherTrackIVs it
+// returns ErrIVReuse for an epoch whose IV was already used.
+func (s *RekeyingStream) Seek(offset uint64) error {
+	if err := s.setupEpoch(offset / s.limit); err != nil {
+		return err
+	}
+	n := offset % s.limit
+	s.c.skip(n)
+	s.left -= n
+	return nil
+}
+
+// XORKeyStream XORs each byte in src with a byte from the key stream and
+// writes the result to dst, rekeying whenever the limit is reached. As a
+// cipher.Stream has no way to return an error, it panics if the IV setup
+// fails, such as on a Cipher from NewCipherTrackIVs that has already used
+// the next epoch's IV.
+func (s *RekeyingStream) XORKeyStream(dst, src []byte) {
+	if len(dst) < len(src) {
+		panic("crypto/rabbit: output smaller than input")
+	}
+	for len(src) > 0 {
+		if s.left == 0 {
+			if err := s.setupEpoch(s.epoch + 1); err != nil {
+				panic(err)
+			}
+		}
+		n := len(src)
+		if uint64(n) > s.left {
+			n = int(s.left)
+		}
+		s.c.xorKeyStream(dst[:n], src[:n])
+		s.left -= uint64(n)
+		dst, src = dst[n:], src[n:]
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"testing"
+)
+
+var _ cipher.Stream = (*RekeyingStream)(nil)
+
+func TestRekeyingStream(t *testing.T) {
+	key := testVectors[0].key
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 0x80}
+	const limit = 40
+	c1, _ := NewCipher(key)
+	enc, err := NewRekeyingStream(c1, iv, limit)
+	if err != nil {
+		t.Fatalf("NewRekeyingStream: %v", err)
+	}
+	src := make([]byte, 150)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	ciphertext := make([]byte, len(src))
+	for k, l := 0, 1; k < len(src); l++ {
+		if k+l > len(src) {
+			l = len(src) - k
+		}
+		enc.XORKeyStream(ciphertext[k:k+l], src[k:k+l])
+		k += l
+	}
+	if enc.Epoch() != 3 {
+		t.Errorf("Epoch = %d, want 3", enc.Epoch())
+	}
+	ref, _ := NewCipher(key)
+	for e := 0; e*limit < len(src); e++ {
+		eiv := append([]byte(nil), iv...)
+		eiv[0] ^= byte(e)
+		ref.SetupIV(eiv)
+		end := (e + 1) * limit
+		if end > len(src) {
+			end = len(src)
+		}
+		want := make([]byte, end-e*limit)
+		ref.XORKeyStream(want, src[e*limit:end])
+		if !bytes.Equal(ciphertext[e*limit:end], want) {
+			t.Fatalf("epoch %d: ciphertext mismatch", e)
+		}
+	}
+	c2, _ := NewCipher(key)
+	dec, _ := NewRekeyingStream(c2, iv, limit)
+	got := make([]byte, len(src))
+	dec.XORKeyStream(got, ciphertext)
+	if !bytes.Equal(got, src) {
+		t.Fatalf("RekeyingStream: round trip mismatch")
+	}
+
+	// Re-sync at any offset, including across epochs and back.
+	for _, off := range []int{0, 1, 39, 40, 41, 95, 149, 7} {
+		if err := dec.Seek(uint64(off)); err != nil {
+			t.Fatalf("Seek(%d): %v", off, err)
+		}
+		if dec.Epoch() != uint64(off/limit) {
+			t.Fatalf("Seek(%d): Epoch = %d, want %d", off, dec.Epoch(), off/limit)
+		}
+		got := make([]byte, len(src)-off)
+		dec.XORKeyStream(got, ciphertext[off:])
+		if !bytes.Equal(got, src[off:]) {
+			t.Fatalf("Seek(%d): decryption mismatch", off)
+		}
+	}
+
+	if _, err := NewRekeyingStream(c2, iv[:4], limit); err != IVSizeError(4) {
+		t.Errorf("NewRekeyingStream: got error %v, want IVSizeError(4)", err)
+	}
+}
+
+func TestRekeyingStreamIDs(t *testing.T) {
+	key := testVectors[0].key
+	const limit = 32
+	var streams [2][]byte
+	for i, iv := range [][]byte{
+		{0, 0, 0, 0, 0, 0, 0, 1},
+		{0, 0, 0, 0, 0, 0, 0, 2},
+	} {
+		c, _ := NewCipher(key)
+		s, _ := NewRekeyingStream(c, iv, limit)
+		streams[i] = make([]byte, 4*limit)
+		s.XORKeyStream(streams[i], streams[i])
+	}
+	for e := 0; e < 4; e++ {
+		a := streams[0][e*limit : (e+1)*limit]
+		for f := 0; f < 4; f++ {
+			if bytes.Equal(a, streams[1][f*limit:(f+1)*limit]) {
+				t.Fatalf("epoch %d of stream 0 reuses epoch %d of stream 1", e, f)
+			}
+		}
+	}
+
+	// The iv keeps the stream apart from SetupIVUint64 users of the key.
+	c, _ := NewCipher(key)
+	s, _ := NewRekeyingStream(c, []byte{0, 0, 0, 0, 0, 0, 0, 1}, limit)
+	got := make([]byte, limit)
+	s.XORKeyStream(got, got)
+	d, _ := NewCipher(key)
+	d.SetupIV(make([]byte, IVSize))
+	if bytes.Equal(got, d.Keystream(limit)) {
+		t.Fatalf("RekeyingStream: epoch 0 uses the all-zero IV")
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	for i := 0; i < len(testVectors); i += 3 {
+		r := testVectors[i]
+		c, _ := NewCipherWithIV(r.key, r.iv)
+		c.ProcessStream(make([]byte, i))
+		old := c.Clone()
+
+		c.Ratchet()
+		next := old.Keystream(KeySize)
+		want, _ := NewCipher(next)
+		if StateOf(c) != StateOf(want) {
+			t.Fatalf("testVectors [%d]: Ratchet: state differs from NewCipher with the next key stream bytes", i)
+		}
+
+		// The old state continues with different key stream.
+		got := c.Keystream(64)
+		if bytes.Equal(got, old.Keystream(64)) {
+			t.Fatalf("testVectors [%d]: Ratchet: old state reproduces the new key stream", i)
+		}
+		s := StateOf(c)
+		o := StateOf(old)
+		if s.CX == o.CX || s.CC == o.CC || s.X == o.X || s.C == o.C {
+			t.Fatalf("testVectors [%d]: Ratchet: old state survives", i)
+		}
+
+		// Ratcheting in lockstep keeps both ends in sync.
+		a, _ := NewCipherWithIV(r.key, r.iv)
+		b, _ := NewCipherWithIV(r.key, r.iv)
+		for m := 0; m < 4; m++ {
+			msg := []byte(fmt.Sprintf("message %d", m))
+			ct := append([]byte(nil), msg...)
+			a.ProcessStream(ct)
+			b.ProcessStream(ct)
+			if !bytes.Equal(ct, msg) {
+				t.Fatalf("testVectors [%d]: Ratchet: message %d: round trip mismatch", i, m)
+			}
+			a.Ratchet()
+			b.Ratchet()
+		}
+	}
+}
+
+func TestRatchetRounds(t *testing.T) {
+	key := testVectors[2].key
+	c, _ := NewCipherRounds(key, 6)
+	old := c.Clone()
+	c.Ratchet()
+	want, _ := NewCipherRounds(old.Keystream(KeySize), 6)
+	if StateOf(c) != StateOf(want) {
+		t.Fatalf("Ratchet: NewCipherRounds(key, 6) did not keep 6 key setup rounds")
+	}
+	c.Ratchet()
+	want.Ratchet()
+	if StateOf(c) != StateOf(want) {
+		t.Fatalf("Ratchet: second ratchet differs")
+	}
+
+	// SetKey goes back to the standard key setup, for Ratchet too.
+	c.SetKey(key)
+	d, _ := NewCipher(key)
+	c.Ratchet()
+	d.Ratchet()
+	if StateOf(c) != StateOf(d) {
+		t.Fatalf("Ratchet after SetKey: state differs from a standard Cipher")
+	}
+
+	// MarshalBinary does not record rounds, so UnmarshalBinary goes back to
+	// the standard key setup too.
+	e, _ := NewCipherRounds(key, 6)
+	data, _ := d.MarshalBinary()
+	if err := e.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	e.Ratchet()
+	d.Ratchet()
+	if StateOf(e) != StateOf(d) {
+		t.Fatalf("Ratchet after UnmarshalBinary: state differs from a standard Cipher")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+var errBase64 = errors.New("crypto/rabbit: invalid base64 input")
+
+// EncryptToString encrypts plaintext with the next len(plaintext) bytes of
+// key stream and returns the result in unpadded URL-safe base64
+// (base64.RawURLEncoding), suitable for tokens and config files.
+func (c *Cipher) EncryptToString(plaintext []byte) string {
+	b := make([]byte, len(plaintext))
+	c.xorKeyStream(b, plaintext)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecryptString decodes s as produced by EncryptToString and decrypts it
+// with the next bytes of key stream. If s is not valid unpadded URL-safe
+// base64, DecryptString returns an error and no output, and the key stream
+// is not advanced.
+func (c *Cipher) DecryptString(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBase64
+	}
+	c.xorKeyStream(b, b)
+	return b, nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rabbit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncryptToString(t *testing.T) {
+	r := testVectors[6]
+	c, _ := NewCipherWithIV(r.key, r.iv)
+	d, _ := NewCipherWithIV(r.key, r.iv)
+	for _, msg := range []string{"", "a", "user=admin;exp=1700000000", strings.Repeat("\xff", 40)} {
+		s := c.EncryptToString([]byte(msg))
+		if strings.ContainsAny(s, "+/=") {
+			t.Errorf("EncryptToString(%q) = %q, want unpadded URL-safe base64", msg, s)
+		}
+		got, err := d.DecryptString(s)
+		if err != nil {
+			t.Fatalf("DecryptString(%q): %v", s, err)
+		}
+		if !bytes.Equal(got, []byte(msg)) {
+			t.Fatalf("DecryptString(%q) = %q, want %q", s, got, msg)
+		}
+	}
+	n := d.BytesProcessed()
+	for _, bad := range []string{"a", "ab+c", "ab/c", "abc=", "a b"} {
+		if got, err := d.DecryptString(bad); err == nil || got != nil {
+			t.Errorf("DecryptString(%q) = %q, %v, want error and no output", bad, got, err)
+		}
+	}
+	if d.BytesProcessed() != n {
+		t.Errorf("DecryptString: key stream advanced on invalid input")
+	}
+}
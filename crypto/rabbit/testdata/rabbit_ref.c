@@ -0,0 +1,143 @@
+// Copyright (c) 2010, Suryandaru Triandana. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/* A minimal Rabbit implementation written from RFC 4503 alone, without
+ * reference to the Go package, used to generate interop.txt. */
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+typedef struct { uint32_t x[8], c[8], phi; } state;
+
+static const uint32_t A[8] = {
+	0x4D34D34D, 0xD34D34D3, 0x34D34D34, 0x4D34D34D,
+	0xD34D34D3, 0x34D34D34, 0x4D34D34D, 0xD34D34D3,
+};
+
+static uint32_t rotl(uint32_t v, int n) { return v << n | v >> (32 - n); }
+
+static uint32_t g(uint32_t u, uint32_t v) {
+	uint64_t s = (uint64_t)(uint32_t)(u + v);
+	s *= s;
+	return (uint32_t)s ^ (uint32_t)(s >> 32);
+}
+
+static void next(state *s) {
+	uint32_t gg[8];
+	int j;
+	for (j = 0; j < 8; j++) {
+		uint64_t t = (uint64_t)s->c[j] + A[j] + s->phi;
+		s->phi = (uint32_t)(t >> 32);
+		s->c[j] = (uint32_t)t;
+	}
+	for (j = 0; j < 8; j++)
+		gg[j] = g(s->x[j], s->c[j]);
+	s->x[0] = gg[0] + rotl(gg[7], 16) + rotl(gg[6], 16);
+	s->x[1] = gg[1] + rotl(gg[0], 8) + gg[7];
+	s->x[2] = gg[2] + rotl(gg[1], 16) + rotl(gg[0], 16);
+	s->x[3] = gg[3] + rotl(gg[2], 8) + gg[1];
+	s->x[4] = gg[4] + rotl(gg[3], 16) + rotl(gg[2], 16);
+	s->x[5] = gg[5] + rotl(gg[4], 8) + gg[3];
+	s->x[6] = gg[6] + rotl(gg[5], 16) + rotl(gg[4], 16);
+	s->x[7] = gg[7] + rotl(gg[6], 8) + gg[5];
+}
+
+static void keysetup(state *s, const uint8_t key[16]) {
+	uint32_t k[8];
+	int j;
+	for (j = 0; j < 8; j++)
+		k[j] = key[2 * j] | (uint32_t)key[2 * j + 1] << 8;
+	for (j = 0; j < 8; j++) {
+		if (j % 2 == 0) {
+			s->x[j] = k[(j + 1) % 8] << 16 | k[j];
+			s->c[j] = k[(j + 4) % 8] << 16 | k[(j + 5) % 8];
+		} else {
+			s->x[j] = k[(j + 5) % 8] << 16 | k[(j + 4) % 8];
+			s->c[j] = k[j] << 16 | k[(j + 1) % 8];
+		}
+	}
+	s->phi = 0;
+	for (j = 0; j < 4; j++)
+		next(s);
+	for (j = 0; j < 8; j++)
+		s->c[j] ^= s->x[(j + 4) % 8];
+}
+
+static void ivsetup(state *s, const uint8_t iv[8]) {
+	uint32_t lo = iv[0] | iv[1] << 8 | iv[2] << 16 | (uint32_t)iv[3] << 24;
+	uint32_t hi = iv[4] | iv[5] << 8 | iv[6] << 16 | (uint32_t)iv[7] << 24;
+	uint32_t d[4];
+	int j;
+	d[0] = lo;
+	d[1] = (hi & 0xFFFF0000) | lo >> 16;
+	d[2] = hi;
+	d[3] = hi << 16 | (lo & 0xFFFF);
+	for (j = 0; j < 8; j++)
+		s->c[j] ^= d[j % 4];
+	for (j = 0; j < 4; j++)
+		next(s);
+}
+
+static void block(state *s, uint8_t out[16]) {
+	uint16_t w[8];
+	int j;
+	next(s);
+	w[0] = (s->x[0] & 0xFFFF) ^ (s->x[5] >> 16);
+	w[1] = (s->x[0] >> 16) ^ (s->x[3] & 0xFFFF);
+	w[2] = (s->x[2] & 0xFFFF) ^ (s->x[7] >> 16);
+	w[3] = (s->x[2] >> 16) ^ (s->x[5] & 0xFFFF);
+	w[4] = (s->x[4] & 0xFFFF) ^ (s->x[1] >> 16);
+	w[5] = (s->x[4] >> 16) ^ (s->x[7] & 0xFFFF);
+	w[6] = (s->x[6] & 0xFFFF) ^ (s->x[3] >> 16);
+	w[7] = (s->x[6] >> 16) ^ (s->x[1] & 0xFFFF);
+	for (j = 0; j < 8; j++) {
+		out[2 * j] = (uint8_t)w[j];
+		out[2 * j + 1] = (uint8_t)(w[j] >> 8);
+	}
+}
+
+static void hex(const char *h, uint8_t *b, int n) {
+	int i;
+	if ((int)strlen(h) != 2 * n) {
+		fprintf(stderr, "bad hex length\n");
+		exit(1);
+	}
+	for (i = 0; i < n; i++)
+		sscanf(h + 2 * i, "%2hhx", &b[i]);
+}
+
+/* usage: rabbit_ref KEYHEX [IVHEX|-] [NBYTES]
+ * Writes NBYTES of raw key stream to stdout. With no NBYTES, XORs stdin. */
+int main(int argc, char **argv) {
+	state s;
+	uint8_t key[16], iv[8], ks[16];
+	long n, i;
+	int c;
+	if (argc < 2) {
+		fprintf(stderr, "usage: rabbit_ref KEYHEX [IVHEX|-] [NBYTES]\n");
+		return 2;
+	}
+	hex(argv[1], key, 16);
+	keysetup(&s, key);
+	if (argc > 2 && strcmp(argv[2], "-") != 0) {
+		hex(argv[2], iv, 8);
+		ivsetup(&s, iv);
+	}
+	if (argc > 3) {
+		n = atol(argv[3]);
+		for (i = 0; i < n; i++) {
+			if (i % 16 == 0)
+				block(&s, ks);
+			putchar(ks[i % 16]);
+		}
+		return 0;
+	}
+	for (i = 0; (c = getchar()) != EOF; i++) {
+		if (i % 16 == 0)
+			block(&s, ks);
+		putchar(c ^ ks[i % 16]);
+	}
+	return 0;
+}
@@ -0,0 +1,3 @@
+module github.com/kanghaiyang/go-rabbit
+
+go 1.21